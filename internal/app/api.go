@@ -0,0 +1,345 @@
+package app
+
+import (
+	"encoding/json"
+	"ikoyhn/podcast-sponsorblock/internal/common"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"ikoyhn/podcast-sponsorblock/internal/services"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type addPodcastRequest struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	// only used by CUSTOM podcasts
+	PodcastName string                    `json:"podcast_name"`
+	Description string                    `json:"description"`
+	ImageUrl    string                    `json:"image_url"`
+	Sources     []customFeedSourceRequest `json:"sources"`
+}
+
+type customFeedSourceRequest struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type updatePodcastRequest struct {
+	PodcastName *string `json:"podcast_name"`
+	Description *string `json:"description"`
+	Category    *string `json:"category"`
+	ImageUrl    *string `json:"image_url"`
+	ArtistName  *string `json:"artist_name"`
+	Explicit    *string `json:"explicit"`
+	// merged onto the saved settings, settings left out keep their value
+	FeedSettings json.RawMessage `json:"feed_settings"`
+	// replaces the sources of a CUSTOM podcast
+	Sources *[]customFeedSourceRequest `json:"sources"`
+}
+
+type downloadResponse struct {
+	models.DownloadJob
+	Progress *services.DownloadProgress `json:"progress,omitempty"`
+}
+
+type updateEpisodeRequest struct {
+	EpisodeName        *string `json:"episode_name"`
+	EpisodeDescription *string `json:"episode_description"`
+	PublishedDate      *string `json:"published_date"`
+}
+
+func registerApiRoutes(e *echo.Echo) {
+	api := e.Group("/api/v1")
+
+	api.GET("/podcasts", func(c echo.Context) error {
+		podcasts, err := database.GetAllPodcasts()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, podcasts)
+	})
+
+	api.POST("/podcasts", func(c echo.Context) error {
+		var req addPodcastRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+		}
+		if req.Id == "" || !common.IsValidID(req.Id) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid podcast id")
+		}
+		if database.GetPodcast(req.Id) != nil {
+			return echo.NewHTTPError(http.StatusConflict, "Podcast already exists")
+		}
+
+		podcastType := enum.PodcastType(strings.ToUpper(req.Type))
+		if podcastType == enum.CUSTOM {
+			podcast, err := services.AddCustomFeed(models.Podcast{
+				Id:          req.Id,
+				PodcastName: req.PodcastName,
+				Description: req.Description,
+				ImageUrl:    req.ImageUrl,
+			}, toCustomFeedSources(req.Sources))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			return c.JSON(http.StatusCreated, podcast)
+		}
+
+		podcast, err := services.AddPodcast(req.Id, podcastType)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusCreated, podcast)
+	})
+
+	api.GET("/podcasts/:podcastId", func(c echo.Context) error {
+		podcast, err := findPodcast(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, podcast)
+	})
+
+	api.PUT("/podcasts/:podcastId", func(c echo.Context) error {
+		podcast, err := findPodcast(c)
+		if err != nil {
+			return err
+		}
+		var req updatePodcastRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+		}
+		if req.Sources != nil && services.GetPodcastType(podcast) != enum.CUSTOM {
+			return echo.NewHTTPError(http.StatusBadRequest, "Only custom feeds have sources")
+		}
+		feedSettings, err := mergeFeedSettings(podcast.Id, req.FeedSettings)
+		if err != nil {
+			return err
+		}
+		if feedSettings != nil {
+			if cookiesFile := strings.TrimSpace(feedSettings.CookiesFile); cookiesFile != "" && !common.IsPlainFilename(cookiesFile) {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid cookies file, use a file name in the config folder")
+			}
+			if err := services.ValidateFeedSettings(feedSettings, services.GetPodcastType(podcast)); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		setIfPresent(&podcast.PodcastName, req.PodcastName)
+		setIfPresent(&podcast.Description, req.Description)
+		setIfPresent(&podcast.Category, req.Category)
+		setIfPresent(&podcast.ImageUrl, req.ImageUrl)
+		setIfPresent(&podcast.ArtistName, req.ArtistName)
+		setIfPresent(&podcast.Explicit, req.Explicit)
+		if err := database.UpdatePodcast(podcast); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		if feedSettings != nil {
+			services.SaveFeedSettings(feedSettings)
+		}
+		if req.Sources != nil {
+			if err := services.UpdateCustomFeedSources(podcast.Id, toCustomFeedSources(*req.Sources)); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+		services.InvalidateFeedCache(podcast.Id)
+		return c.JSON(http.StatusOK, database.GetPodcastWithEpisodes(podcast.Id))
+	})
+
+	api.DELETE("/podcasts/:podcastId", func(c echo.Context) error {
+		podcast, err := findPodcast(c)
+		if err != nil {
+			return err
+		}
+		if err := database.DeletePodcast(podcast.Id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		services.InvalidateFeedCache(podcast.Id)
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	api.POST("/podcasts/:podcastId/refresh", func(c echo.Context) error {
+		podcast, err := findPodcast(c)
+		if err != nil {
+			return err
+		}
+		if err := services.RefreshPodcast(podcast.Id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, database.GetPodcastWithEpisodes(podcast.Id))
+	})
+
+	api.GET("/podcasts/:podcastId/episodes", func(c echo.Context) error {
+		podcast, err := findPodcast(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, podcast.PodcastEpisodes)
+	})
+
+	api.PUT("/podcasts/:podcastId/episodes/:episodeId", func(c echo.Context) error {
+		episode, err := findEpisode(c)
+		if err != nil {
+			return err
+		}
+		var req updateEpisodeRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+		}
+
+		setIfPresent(&episode.EpisodeName, req.EpisodeName)
+		setIfPresent(&episode.EpisodeDescription, req.EpisodeDescription)
+		if req.PublishedDate != nil {
+			publishedDate, err := time.Parse(time.RFC3339, *req.PublishedDate)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid published date, use RFC 3339")
+			}
+			// stored like the YouTube dates so they sort and compare as text
+			episode.PublishedDate = publishedDate.UTC().Format(time.RFC3339)
+		}
+		if err := database.UpdatePodcastEpisode(episode); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		services.InvalidateFeedCache(episode.PodcastId)
+		return c.JSON(http.StatusOK, episode)
+	})
+
+	api.DELETE("/podcasts/:podcastId/episodes/:episodeId", func(c echo.Context) error {
+		episode, err := findEpisode(c)
+		if err != nil {
+			return err
+		}
+		if err := database.DeletePodcastEpisode(episode.PodcastId, episode.Id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		services.InvalidateFeedCache(episode.PodcastId)
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	api.GET("/quota", func(c echo.Context) error {
+		days := 0
+		if value := c.QueryParam("days"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid days")
+			}
+			days = n
+		}
+		report, err := services.GetQuotaReport(days)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, report)
+	})
+
+	api.GET("/downloads", func(c echo.Context) error {
+		jobs, err := database.GetDownloadJobs(strings.ToUpper(c.QueryParam("status")))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		downloads := make([]downloadResponse, 0, len(jobs))
+		for _, job := range jobs {
+			downloads = append(downloads, downloadResponse{
+				DownloadJob: job,
+				Progress:    services.GetFileDownloadProgress(job.FileName),
+			})
+		}
+		return c.JSON(http.StatusOK, downloads)
+	})
+
+	api.GET("/downloads/events", func(c echo.Context) error {
+		return streamDownloadEvents(c)
+	})
+
+	api.GET("/downloads/:fileName", func(c echo.Context) error {
+		fileName := c.Param("fileName")
+		if !common.IsValidFilename(fileName) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid file name")
+		}
+		job := database.GetDownloadJob(fileName)
+		if job == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Download not found")
+		}
+		return c.JSON(http.StatusOK, downloadResponse{
+			DownloadJob: *job,
+			Progress:    services.GetFileDownloadProgress(fileName),
+		})
+	})
+
+	api.POST("/downloads/:fileName/retry", func(c echo.Context) error {
+		fileName := c.Param("fileName")
+		if !common.IsValidFilename(fileName) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid file name")
+		}
+		job, err := services.RetryDownload(fileName)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return c.JSON(http.StatusOK, job)
+	})
+}
+
+func findPodcast(c echo.Context) (*models.Podcast, error) {
+	podcastId := c.Param("podcastId")
+	if !common.IsValidID(podcastId) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid podcast id")
+	}
+	podcast := database.GetPodcastWithEpisodes(podcastId)
+	if podcast == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Podcast not found")
+	}
+	return podcast, nil
+}
+
+func findEpisode(c echo.Context) (*models.PodcastEpisode, error) {
+	podcastId := c.Param("podcastId")
+	if !common.IsValidID(podcastId) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid podcast id")
+	}
+	episodeId, err := strconv.ParseInt(c.Param("episodeId"), 10, 32)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid episode id")
+	}
+	episode := database.GetPodcastEpisode(podcastId, int32(episodeId))
+	if episode == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Episode not found")
+	}
+	return episode, nil
+}
+
+// Apply the settings sent in a request on top of the saved settings of the podcast
+func mergeFeedSettings(podcastId string, body json.RawMessage) (*models.FeedSettings, error) {
+	if len(body) == 0 || string(body) == "null" {
+		return nil, nil
+	}
+	settings := database.GetFeedSettings(podcastId)
+	if settings == nil {
+		settings = &models.FeedSettings{}
+	}
+	if err := json.Unmarshal(body, settings); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid feed settings")
+	}
+	settings.PodcastId = podcastId
+	return settings, nil
+}
+
+func setIfPresent(field *string, value *string) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func toCustomFeedSources(sources []customFeedSourceRequest) []models.CustomFeedSource {
+	customFeedSources := make([]models.CustomFeedSource, 0, len(sources))
+	for _, source := range sources {
+		customFeedSources = append(customFeedSources, models.CustomFeedSource{SourceId: source.Id, SourceType: source.Type})
+	}
+	return customFeedSources
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"ikoyhn/podcast-sponsorblock/internal/common"
 	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
 	"ikoyhn/podcast-sponsorblock/internal/services"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -17,6 +19,8 @@ import (
 	"github.com/robfig/cron"
 )
 
+const feedMaxAgeSeconds = 300
+
 func Start() {
 	ytdlp.MustInstall(context.TODO(), nil)
 	e := echo.New()
@@ -25,6 +29,7 @@ func Start() {
 	database.TrackEpisodeFiles()
 
 	setupCron()
+	services.StartDownloadWorkers()
 	setupLogging(e)
 	setupHandlers(e)
 	registerRoutes(e)
@@ -32,27 +37,27 @@ func Start() {
 
 func registerRoutes(e *echo.Echo) {
 	e.GET("/channel/:channelId", func(c echo.Context) error {
-		checkAuthentication(c)
-		if !common.IsValidParam(c.Param("channelId")) {
-			c.Error(echo.NewHTTPError(http.StatusBadRequest, "Invalid channel id"))
-		}
-		data := services.BuildChannelRssFeed(c.Param("channelId"), handler(c.Request()))
-		c.Response().Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
-		c.Response().Header().Set("Content-Length", strconv.Itoa(len(data)))
-		c.Response().Header().Del("Transfer-Encoding")
-		return c.Blob(http.StatusOK, "application/rss+xml; charset=utf-8", data)
+		return serveChannelFeed(c, enum.AUDIO)
 	})
 
 	e.GET("/rss/:youtubePlaylistId", func(c echo.Context) error {
-		checkAuthentication(c)
-		if !common.IsValidParam(c.Param("youtubePlaylistId")) {
-			c.Error(echo.NewHTTPError(http.StatusBadRequest, "Invalid youtube playlist id"))
-		}
-		data := services.BuildPlaylistRssFeed(c.Param("youtubePlaylistId"), handler(c.Request()))
-		c.Response().Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
-		c.Response().Header().Set("Content-Length", strconv.Itoa(len(data)))
-		c.Response().Header().Del("Transfer-Encoding")
-		return c.Blob(http.StatusOK, "application/rss+xml; charset=utf-8", data)
+		return servePlaylistFeed(c, enum.AUDIO)
+	})
+
+	e.GET("/video/channel/:channelId", func(c echo.Context) error {
+		return serveChannelFeed(c, enum.VIDEO)
+	})
+
+	e.GET("/video/rss/:youtubePlaylistId", func(c echo.Context) error {
+		return servePlaylistFeed(c, enum.VIDEO)
+	})
+
+	e.GET("/feed/:customId", func(c echo.Context) error {
+		return serveCustomFeed(c, enum.AUDIO)
+	})
+
+	e.GET("/video/feed/:customId", func(c echo.Context) error {
+		return serveCustomFeed(c, enum.VIDEO)
 	})
 
 	e.GET("/media/:youtubeVideoId", func(c echo.Context) error {
@@ -65,13 +70,21 @@ func registerRoutes(e *echo.Echo) {
 		if !common.IsValidFilename(fileName) {
 			c.Error(echo.ErrNotFound)
 		}
-		file, err := os.Open("/config/audio/" + fileName)
-		needRedownload, totalTimeSkipped := services.DeterminePodcastDownload(fileName[:len(fileName)-4])
+		youtubeVideoId, format, ok := services.ParseMediaFileName(fileName)
+		if !ok {
+			return echo.ErrNotFound
+		}
+		contentType := format.EnclosureType.String()
+
+		file, err := os.Open(format.FilePath(youtubeVideoId))
+		needRedownload, totalTimeSkipped := services.DeterminePodcastDownload(youtubeVideoId)
 		if file == nil || err != nil || needRedownload {
-			database.UpdateEpisodePlaybackHistory(fileName[:len(fileName)-4], totalTimeSkipped)
-			fileName, done := services.GetYoutubeVideo(fileName)
-			<-done
-			file, err = os.Open("/config/audio/" + fileName + ".m4a")
+			database.UpdateEpisodePlaybackHistory(youtubeVideoId, totalTimeSkipped)
+			fileName, done := services.GetYoutubeVideo(youtubeVideoId, format)
+			if isMediaPending(done) {
+				return servePendingMedia(c, fileName)
+			}
+			file, err = os.Open(format.FilePath(youtubeVideoId))
 			if err != nil || file == nil {
 				return err
 			}
@@ -79,21 +92,53 @@ func registerRoutes(e *echo.Echo) {
 
 			rangeHeader := c.Request().Header.Get("Range")
 			if rangeHeader != "" {
-				http.ServeFile(c.Response().Writer, c.Request(), "/config/audio/"+fileName+".m4a")
+				http.ServeFile(c.Response().Writer, c.Request(), format.FilePath(youtubeVideoId))
 				return nil
 			}
-			return c.Stream(http.StatusOK, "audio/mp4", file)
+			return c.Stream(http.StatusOK, contentType, file)
 		}
 
-		database.UpdateEpisodePlaybackHistory(fileName[:len(fileName)-4], totalTimeSkipped)
+		database.UpdateEpisodePlaybackHistory(youtubeVideoId, totalTimeSkipped)
 		rangeHeader := c.Request().Header.Get("Range")
 		if rangeHeader != "" {
-			http.ServeFile(c.Response().Writer, c.Request(), "/config/audio/"+fileName)
+			http.ServeFile(c.Response().Writer, c.Request(), format.FilePath(youtubeVideoId))
 			return nil
 		}
-		return c.Stream(http.StatusOK, "audio/mp4", file)
+		return c.Stream(http.StatusOK, contentType, file)
+	})
+
+	e.GET("/chapters/:fileName", func(c echo.Context) error {
+		checkAuthentication(c)
+
+		youtubeVideoId, ok := strings.CutSuffix(c.Param("fileName"), ".json")
+		if !ok || youtubeVideoId == "" || !common.IsValidID(youtubeVideoId) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid youtube video id")
+		}
+		c.Response().Header().Set("Content-Type", services.CHAPTERS_MIME_TYPE)
+		return c.JSON(http.StatusOK, services.GetEpisodeChapters(youtubeVideoId))
 	})
 
+	e.GET("/transcripts/:fileName", func(c echo.Context) error {
+		checkAuthentication(c)
+
+		fileName := c.Param("fileName")
+		ext := filepath.Ext(fileName)
+		youtubeVideoId := strings.TrimSuffix(fileName, ext)
+		mimeType, ok := services.GetTranscriptMimeType(strings.TrimPrefix(ext, "."))
+		if !ok || youtubeVideoId == "" || !common.IsValidID(youtubeVideoId) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid transcript file name")
+		}
+		data, language, err := services.GetEpisodeTranscript(youtubeVideoId, strings.TrimPrefix(ext, "."))
+		if err != nil {
+			log.Errorf("[TRANSCRIPT] %s: %v", youtubeVideoId, err)
+			return echo.NewHTTPError(http.StatusNotFound, "Transcript not found")
+		}
+		c.Response().Header().Set("Content-Language", language)
+		return c.Blob(http.StatusOK, mimeType+"; charset=utf-8", data)
+	})
+
+	registerApiRoutes(e)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -105,6 +150,93 @@ func registerRoutes(e *echo.Echo) {
 
 }
 
+func serveChannelFeed(c echo.Context, mediaType enum.MediaType) error {
+	checkAuthentication(c)
+	if !common.IsValidParam(c.Param("channelId")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid channel id")
+	}
+	options, err := services.ParseFeedOptions(c.Request().URL.Path, c.QueryParams(), mediaType)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	data, err := services.BuildChannelRssFeed(c.Param("channelId"), handler(c.Request()), options)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return serveFeed(c, data, options.Format)
+}
+
+func servePlaylistFeed(c echo.Context, mediaType enum.MediaType) error {
+	checkAuthentication(c)
+	if !common.IsValidParam(c.Param("youtubePlaylistId")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid youtube playlist id")
+	}
+	options, err := services.ParseFeedOptions(c.Request().URL.Path, c.QueryParams(), mediaType)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	data, err := services.BuildPlaylistRssFeed(c.Param("youtubePlaylistId"), handler(c.Request()), options)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return serveFeed(c, data, options.Format)
+}
+
+func serveCustomFeed(c echo.Context, mediaType enum.MediaType) error {
+	checkAuthentication(c)
+	if !common.IsValidID(c.Param("customId")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid custom feed id")
+	}
+	options, err := services.ParseFeedOptions(c.Request().URL.Path, c.QueryParams(), mediaType)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	data, err := services.BuildCustomRssFeed(c.Param("customId"), handler(c.Request()), options)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return serveFeed(c, data, options.Format)
+}
+
+// Serve the feed with validators so polling podcast apps get a 304 when nothing changed
+func serveFeed(c echo.Context, feed *services.Feed, feedFormat enum.FeedFormat) error {
+	if feed == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to build feed")
+	}
+	header := c.Response().Header()
+	header.Set("ETag", feed.ETag)
+	header.Set("Last-Modified", feed.LastModified.Format(http.TimeFormat))
+	header.Set("Cache-Control", "private, max-age="+strconv.Itoa(feedMaxAgeSeconds))
+
+	if isFeedNotModified(c.Request(), feed) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	contentType := services.GetFeedContentType(feedFormat)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(feed.Data)))
+	header.Del("Transfer-Encoding")
+	return c.Blob(http.StatusOK, contentType, feed.Data)
+}
+
+// If-None-Match takes precedence over If-Modified-Since, see RFC 9110 section 13.2.2
+func isFeedNotModified(r *http.Request, feed *services.Feed) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == feed.ETag {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !feed.LastModified.After(since)
+	}
+	return false
+}
+
 func checkAuthentication(c echo.Context) {
 	if os.Getenv("TOKEN") != "" {
 		token := c.Request().URL.Query().Get("token")
@@ -122,6 +254,10 @@ func setupCron() {
 	c := cron.New()
 	c.AddFunc(cronSchedule, func() {
 		database.DeletePodcastCronJob()
+		services.ClearFeedCache()
+	})
+	c.AddFunc("@every 1m", func() {
+		services.RefreshDuePodcasts()
 	})
 	c.Start()
 }
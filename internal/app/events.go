@@ -0,0 +1,59 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"ikoyhn/podcast-sponsorblock/internal/services"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const sseKeepAliveInterval = 15 * time.Second
+
+// Stream download progress as server-sent events, starting with every download currently running
+func streamDownloadEvents(c echo.Context) error {
+	updates, unsubscribe := services.SubscribeDownloadProgress()
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, progress := range services.GetDownloadProgress() {
+		if err := writeProgressEvent(w, progress); err != nil {
+			return nil
+		}
+	}
+	w.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case progress := <-updates:
+			if err := writeProgressEvent(w, progress); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		}
+		w.Flush()
+	}
+}
+
+func writeProgressEvent(w *echo.Response, progress services.DownloadProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/services"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/labstack/gommon/log"
+)
+
+const (
+	MEDIA_PENDING_WAIT        = "wait"
+	MEDIA_PENDING_RETRY       = "retry"
+	MEDIA_PENDING_PLACEHOLDER = "placeholder"
+
+	defaultRetryAfterSeconds = 30
+	maxRetryAfterSeconds     = 300
+)
+
+// Get how a media request is answered while the episode is still downloading, set with MEDIA_PENDING_MODE
+func getMediaPendingMode() string {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("MEDIA_PENDING_MODE")))
+	switch mode {
+	case MEDIA_PENDING_RETRY, MEDIA_PENDING_PLACEHOLDER:
+		return mode
+	case "", MEDIA_PENDING_WAIT:
+		return MEDIA_PENDING_WAIT
+	default:
+		log.Errorf("Unknown MEDIA_PENDING_MODE %q, waiting for downloads", mode)
+		return MEDIA_PENDING_WAIT
+	}
+}
+
+// Wait for the download when configured to, otherwise report whether it is still running
+func isMediaPending(done <-chan struct{}) bool {
+	if getMediaPendingMode() == MEDIA_PENDING_WAIT {
+		<-done
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Answer a media request for an episode that is still downloading with either a 202 and Retry-After
+// or the placeholder clip, so podcast apps retry instead of timing out
+func servePendingMedia(c echo.Context, fileName string) error {
+	retryAfter := defaultRetryAfterSeconds
+	if progress := services.GetFileDownloadProgress(fileName); progress != nil && progress.EtaSeconds > 0 {
+		retryAfter = int(progress.EtaSeconds) + 10
+		if retryAfter > maxRetryAfterSeconds {
+			retryAfter = maxRetryAfterSeconds
+		}
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+
+	if getMediaPendingMode() == MEDIA_PENDING_PLACEHOLDER {
+		placeholder, err := services.GetPlaceholderAudio()
+		if err == nil {
+			http.ServeFile(c.Response().Writer, c.Request(), placeholder)
+			return nil
+		}
+	}
+	return c.String(http.StatusAccepted, "Episode is still downloading, retry in "+strconv.Itoa(retryAfter)+" seconds")
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"path/filepath"
 	"strings"
 	"unicode"
 )
@@ -14,6 +15,11 @@ func IsValidFilename(filename string) bool {
 	return true
 }
 
+// Check the name is a single file in a folder, without any path or parent references
+func IsPlainFilename(filename string) bool {
+	return filename != "" && filename != "." && filename != ".." && IsValidFilename(filename) && filepath.Base(filename) == filename
+}
+
 func IsValidParam(param string) bool {
 	if strings.Contains(param, "/") || strings.Contains(param, "\\") || strings.Contains(param, "..") {
 		return false
@@ -2,15 +2,25 @@ package database
 
 import (
 	"errors"
+	"fmt"
 	"ikoyhn/podcast-sponsorblock/internal/common"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
 	"ikoyhn/podcast-sponsorblock/internal/models"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	log "github.com/labstack/gommon/log"
 	"gorm.io/gorm"
 )
 
+var (
+	// episodes that are streaming or scheduled are kept out of feeds until they can be downloaded
+	pendingLiveStatuses = []string{string(enum.IS_LIVE), string(enum.IS_UPCOMING)}
+	hiddenLiveStatuses  = []string{string(enum.IS_LIVE), string(enum.IS_UPCOMING), string(enum.UNAVAILABLE)}
+)
+
 func UpdateEpisodePlaybackHistory(youtubeVideoId string, totalTimeSkipped float64) {
 	log.Info("[DB] Updating episode playback history...")
 	db.Model(&models.EpisodePlaybackHistory{}).
@@ -33,7 +43,11 @@ func DeletePodcastCronJob() {
 	db.Where("last_access_date < ?", oneWeekAgo).Find(&histories)
 
 	for _, history := range histories {
-		os.Remove("/config/audio/" + history.YoutubeVideoId + ".m4a")
+		files, _ := filepath.Glob("/config/audio/" + history.YoutubeVideoId + ".*")
+		transcripts, _ := filepath.Glob("/config/transcripts/" + history.YoutubeVideoId + ".*")
+		for _, file := range append(files, transcripts...) {
+			os.Remove(file)
+		}
 		db.Delete(&history)
 		log.Info("[DB] Deleted old episode playback history... " + history.YoutubeVideoId)
 	}
@@ -56,41 +70,27 @@ func TrackEpisodeFiles() {
 	dbFiles := make([]string, 0)
 	db.Model(&models.EpisodePlaybackHistory{}).Pluck("YoutubeVideoId", &dbFiles)
 
-	missingFiles := make([]string, 0)
-	nonExistentDbFiles := make([]string, 0)
+	// a video can be downloaded in several formats, so track files by their video id
+	fileIds := make(map[string]bool)
 	for _, file := range files {
 		filename := file.Name()
 		if !common.IsValidFilename(filename) {
 			continue
 		}
-		found := false
-		for _, dbFile := range dbFiles {
-			if dbFile == filename[:len(filename)-4] {
-				found = true
-				break
-			}
-		}
-		if !found {
-			missingFiles = append(missingFiles, filename)
-		}
+		fileIds[strings.TrimSuffix(filename, filepath.Ext(filename))] = true
 	}
 
+	dbIds := make(map[string]bool)
+	nonExistentDbFiles := make([]string, 0)
 	for _, dbFile := range dbFiles {
-		found := false
-		for _, file := range files {
-			if dbFile == file.Name()[:len(file.Name())-4] {
-				found = true
-				break
-			}
-		}
-		if !found {
+		dbIds[dbFile] = true
+		if !fileIds[dbFile] {
 			nonExistentDbFiles = append(nonExistentDbFiles, dbFile)
 		}
 	}
 
-	for _, filename := range missingFiles {
-		id := filename[:len(filename)-4]
-		if !common.IsValidID(id) {
+	for id := range fileIds {
+		if dbIds[id] || !common.IsValidID(id) {
 			continue
 		}
 		db.Create(&models.EpisodePlaybackHistory{YoutubeVideoId: id, LastAccessDate: time.Now().Unix(), TotalTimeSkipped: 0})
@@ -146,7 +146,32 @@ func GetLatestEpisode(podcastId string) (*models.PodcastEpisode, error) {
 
 func GetPodcastEpisodesByPodcastId(podcastId string) ([]models.PodcastEpisode, error) {
 	var episodes []models.PodcastEpisode
-	err := db.Where("podcast_id = ?", podcastId).Find(&episodes).Error
+	err := db.Where("podcast_id = ?", podcastId).Order("published_date DESC, id DESC").Find(&episodes).Error
+	if err != nil {
+		return nil, err
+	}
+	return episodes, nil
+}
+
+// Get a page of the newest episodes of the podcasts published since the given RFC 3339 date, a limit of 0
+// returns all of them. A video in more than one of the podcasts is only listed once.
+func GetPodcastEpisodesPage(podcastIds []string, since string, limit int, offset int) ([]models.PodcastEpisode, error) {
+	var episodes []models.PodcastEpisode
+	query := db.Where("podcast_id IN ?", podcastIds)
+	if len(podcastIds) > 1 {
+		query = query.Where("id IN (?)", db.Model(&models.PodcastEpisode{}).
+			Select("MIN(id)").
+			Where("podcast_id IN ?", podcastIds).
+			Group("youtube_video_id"))
+	}
+	if since != "" {
+		query = query.Where("published_date >= ?", since)
+	}
+	query = query.Where("live_status IS NULL OR live_status NOT IN ?", hiddenLiveStatuses).Order("published_date DESC, id DESC")
+	if limit > 0 {
+		query = query.Limit(limit).Offset(offset)
+	}
+	err := query.Find(&episodes).Error
 	if err != nil {
 		return nil, err
 	}
@@ -159,7 +184,7 @@ func SavePlaylistEpisodes(playlistEpisodes []models.PodcastEpisode) {
 
 func GetPodcast(id string) *models.Podcast {
 	var podcastDb models.Podcast
-	err := db.Where("id = ?", id).Find(&podcastDb).Error
+	err := db.Preload("FeedSettings").Preload("Sources").Where("id = ?", id).Find(&podcastDb).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil
@@ -174,3 +199,330 @@ func GetPodcast(id string) *models.Podcast {
 func SavePodcast(podcast *models.Podcast) {
 	db.Create(&podcast)
 }
+
+func GetFeedSettings(podcastId string) *models.FeedSettings {
+	var settings models.FeedSettings
+	err := db.Where("podcast_id = ?", podcastId).Limit(1).Find(&settings).Error
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if settings.PodcastId == "" {
+		return nil
+	}
+	return &settings
+}
+
+// Get the feed settings the media files of the video are made with. A video can be an episode of several
+// podcasts, the files are shared, so the settings of the podcast that saved the video first apply.
+func GetFeedSettingsByVideoId(youtubeVideoId string) *models.FeedSettings {
+	podcastId := GetMediaPodcastIds([]string{youtubeVideoId})[youtubeVideoId]
+	if podcastId == "" {
+		return nil
+	}
+	return GetFeedSettings(podcastId)
+}
+
+// Get the feed settings of the podcasts, podcasts without settings are left out
+func GetFeedSettingsByPodcastIds(podcastIds []string) map[string]*models.FeedSettings {
+	settingsByPodcast := make(map[string]*models.FeedSettings)
+	var settingsList []models.FeedSettings
+	if err := db.Where("podcast_id IN ?", podcastIds).Find(&settingsList).Error; err != nil {
+		log.Error(err)
+	}
+	for i := range settingsList {
+		settingsByPodcast[settingsList[i].PodcastId] = &settingsList[i]
+	}
+	return settingsByPodcast
+}
+
+// Get the podcast that saved each video first, its feed settings apply to the media files of the video
+func GetMediaPodcastIds(youtubeVideoIds []string) map[string]string {
+	podcastIds := make(map[string]string)
+	for start := 0; start < len(youtubeVideoIds); start += 500 {
+		end := min(start+500, len(youtubeVideoIds))
+		var batch []models.PodcastEpisode
+		err := db.Select("youtube_video_id", "podcast_id").
+			Where("id IN (?)", db.Model(&models.PodcastEpisode{}).
+				Select("MIN(id)").
+				Where("youtube_video_id IN ?", youtubeVideoIds[start:end]).
+				Group("youtube_video_id")).
+			Find(&batch).Error
+		if err != nil {
+			log.Error(err)
+		}
+		for _, episode := range batch {
+			podcastIds[episode.YoutubeVideoId] = episode.PodcastId
+		}
+	}
+	return podcastIds
+}
+
+// Get the ids of the podcasts the video is an episode of
+func GetEpisodePodcastIds(youtubeVideoId string) []string {
+	var podcastIds []string
+	err := db.Model(&models.PodcastEpisode{}).
+		Where("youtube_video_id = ?", youtubeVideoId).
+		Distinct().
+		Pluck("podcast_id", &podcastIds).Error
+	if err != nil {
+		log.Error(err)
+	}
+	return podcastIds
+}
+
+// Replace the sources of a custom feed
+func SaveCustomFeedSources(customFeedId string, sources []models.CustomFeedSource) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("custom_feed_id = ?", customFeedId).Delete(&models.CustomFeedSource{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Podcast{}).Where("id = ?", customFeedId).Update("updated_date", time.Now().Unix()).Error; err != nil {
+			return err
+		}
+		if len(sources) == 0 {
+			return nil
+		}
+		return tx.Create(&sources).Error
+	})
+}
+
+// Get the ids of the custom feeds merging the podcast
+func GetCustomFeedIdsBySource(sourceId string) []string {
+	var customFeedIds []string
+	err := db.Model(&models.CustomFeedSource{}).
+		Where("source_id = ?", sourceId).
+		Pluck("custom_feed_id", &customFeedIds).Error
+	if err != nil {
+		log.Error(err)
+	}
+	return customFeedIds
+}
+
+func SaveFeedSettings(settings *models.FeedSettings) {
+	settings.UpdatedDate = time.Now().Unix()
+	db.Save(settings)
+}
+
+func GetAllPodcasts() ([]models.Podcast, error) {
+	var podcasts []models.Podcast
+	err := db.Preload("FeedSettings").Preload("Sources").Order("podcast_name").Find(&podcasts).Error
+	if err != nil {
+		return nil, err
+	}
+	return podcasts, nil
+}
+
+func GetPodcastWithEpisodes(id string) *models.Podcast {
+	var podcastDb models.Podcast
+	err := db.Preload("FeedSettings").
+		Preload("Sources").
+		Preload("PodcastEpisodes", func(tx *gorm.DB) *gorm.DB {
+			return tx.Order("published_date DESC")
+		}).
+		Where("id = ?", id).
+		Limit(1).
+		Find(&podcastDb).Error
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if podcastDb.Id == "" {
+		return nil
+	}
+	return &podcastDb
+}
+
+func UpdatePodcast(podcast *models.Podcast) error {
+	podcast.UpdatedDate = time.Now().Unix()
+	return db.Model(podcast).
+		Select("podcast_name", "description", "category", "image_url", "artist_name", "explicit", "updated_date").
+		Updates(podcast).Error
+}
+
+// Delete a podcast along with its episodes, feed settings and custom feed sources
+func DeletePodcast(id string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("custom_feed_id = ? OR source_id = ?", id, id).Delete(&models.CustomFeedSource{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("podcast_id = ?", id).Delete(&models.PodcastEpisode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("podcast_id = ?", id).Delete(&models.FeedSettings{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.Podcast{}).Error
+	})
+}
+
+func GetPodcastEpisode(podcastId string, episodeId int32) *models.PodcastEpisode {
+	var episode models.PodcastEpisode
+	err := db.Where("podcast_id = ? AND id = ?", podcastId, episodeId).Limit(1).Find(&episode).Error
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if episode.Id == 0 {
+		return nil
+	}
+	return &episode
+}
+
+func UpdatePodcastEpisode(episode *models.PodcastEpisode) error {
+	return db.Model(episode).Select("episode_name", "episode_description", "published_date").Updates(episode).Error
+}
+
+func DeletePodcastEpisode(podcastId string, episodeId int32) error {
+	return db.Where("podcast_id = ? AND id = ?", podcastId, episodeId).Delete(&models.PodcastEpisode{}).Error
+}
+
+func UpdatePodcastUploadsPlaylistId(podcastId string, uploadsPlaylistId string) {
+	db.Model(&models.Podcast{}).Where("id = ?", podcastId).Update("uploads_playlist_id", uploadsPlaylistId)
+}
+
+func GetPodcastsDueForRefresh(now int64) ([]models.Podcast, error) {
+	var podcasts []models.Podcast
+	err := db.Preload("FeedSettings").Where("next_refresh_date <= ?", now).Order("next_refresh_date").Find(&podcasts).Error
+	if err != nil {
+		return nil, err
+	}
+	return podcasts, nil
+}
+
+func UpdatePodcastContentDates(podcastIds []string, contentUpdatedDate int64) {
+	db.Model(&models.Podcast{}).Where("id IN ?", podcastIds).UpdateColumn("content_updated_date", contentUpdatedDate)
+}
+
+func UpdateAllPodcastContentDates(contentUpdatedDate int64) {
+	db.Model(&models.Podcast{}).Where("1 = 1").UpdateColumn("content_updated_date", contentUpdatedDate)
+}
+
+// Get a summary of the episodes of a podcast that changes whenever an episode is added, updated or deleted
+func GetEpisodesVersion(podcastId string) string {
+	var version struct {
+		Count          int64
+		MaxId          int64
+		MaxUpdatedDate int64
+	}
+	err := db.Model(&models.PodcastEpisode{}).
+		Select("COUNT(*) AS count, COALESCE(MAX(id), 0) AS max_id, COALESCE(MAX(updated_date), 0) AS max_updated_date").
+		Where("podcast_id = ?", podcastId).
+		Scan(&version).Error
+	if err != nil {
+		log.Error(err)
+	}
+	return fmt.Sprintf("%d|%d|%d", version.Count, version.MaxId, version.MaxUpdatedDate)
+}
+
+func UpdatePodcastRefreshDates(podcastId string, lastRefreshDate int64, nextRefreshDate int64) {
+	db.Model(&models.Podcast{}).
+		Where("id = ?", podcastId).
+		Updates(map[string]interface{}{"last_refresh_date": lastRefreshDate, "next_refresh_date": nextRefreshDate})
+}
+
+func GetLatestPodcastEpisodes(podcastId string, limit int) ([]models.PodcastEpisode, error) {
+	var episodes []models.PodcastEpisode
+	err := db.Where("podcast_id = ? AND (live_status IS NULL OR live_status NOT IN ?)", podcastId, hiddenLiveStatuses).Order("published_date DESC").Limit(limit).Find(&episodes).Error
+	if err != nil {
+		return nil, err
+	}
+	return episodes, nil
+}
+
+func GetEpisodeChapters(youtubeVideoId string) *models.EpisodeChapters {
+	var chapters models.EpisodeChapters
+	err := db.Where("youtube_video_id = ?", youtubeVideoId).First(&chapters).Error
+	if err != nil {
+		return nil
+	}
+	return &chapters
+}
+
+func SaveEpisodeChapters(chapters *models.EpisodeChapters) {
+	db.Save(chapters)
+}
+
+// Get which of the videos have YouTube chapters cached
+func GetVideoIdsWithChapters(youtubeVideoIds []string) map[string]bool {
+	videoIds := make(map[string]bool)
+	for start := 0; start < len(youtubeVideoIds); start += 500 {
+		end := min(start+500, len(youtubeVideoIds))
+		var batch []string
+		db.Model(&models.EpisodeChapters{}).
+			Where("youtube_video_id IN ? AND chapters NOT IN ?", youtubeVideoIds[start:end], []string{"", "[]", "null"}).
+			Pluck("youtube_video_id", &batch)
+		for _, videoId := range batch {
+			videoIds[videoId] = true
+		}
+	}
+	return videoIds
+}
+
+func UpdateEpisodeRemovedSegments(youtubeVideoId string, removedSegments string) {
+	db.Model(&models.EpisodePlaybackHistory{}).Where("youtube_video_id = ?", youtubeVideoId).Update("removed_segments", removedSegments)
+}
+
+func GetEpisodePlaybackHistories(youtubeVideoIds []string) map[string]models.EpisodePlaybackHistory {
+	histories := make(map[string]models.EpisodePlaybackHistory)
+	for start := 0; start < len(youtubeVideoIds); start += 500 {
+		end := min(start+500, len(youtubeVideoIds))
+		var batch []models.EpisodePlaybackHistory
+		db.Where("youtube_video_id IN ?", youtubeVideoIds[start:end]).Find(&batch)
+		for _, history := range batch {
+			histories[history.YoutubeVideoId] = history
+		}
+	}
+	return histories
+}
+
+// Get the episodes whose duration was never looked up or that were not available yet when they were found.
+// Streams and premieres published before pendingSince are not checked anymore, cancelled ones stay scheduled forever.
+func GetEpisodesToRecheck(podcastId string, pendingSince string, limit int) ([]models.PodcastEpisode, error) {
+	var episodes []models.PodcastEpisode
+	err := db.Where("podcast_id = ? AND ((duration = 0 AND details_checked_date = 0) OR (live_status IN ? AND published_date >= ?))", podcastId, pendingLiveStatuses, pendingSince).
+		Order("published_date DESC").
+		Limit(limit).
+		Find(&episodes).Error
+	return episodes, err
+}
+
+// Get the episodes published since pendingSince that were streaming or scheduled when they were last checked
+func GetPendingLiveEpisodes(podcastId string, pendingSince string, limit int) ([]models.PodcastEpisode, error) {
+	var episodes []models.PodcastEpisode
+	err := db.Where("podcast_id = ? AND live_status IN ? AND published_date >= ?", podcastId, pendingLiveStatuses, pendingSince).
+		Order("published_date DESC").
+		Limit(limit).
+		Find(&episodes).Error
+	return episodes, err
+}
+
+// Update the details of a video that are only known once it is available, a duration of 0 keeps the current one
+func UpdateEpisodeVideoDetails(youtubeVideoId string, duration time.Duration, liveStatus string, isShort bool) {
+	updates := map[string]interface{}{
+		"live_status": liveStatus,
+		"is_short":    isShort,
+	}
+	if duration > 0 {
+		updates["duration"] = duration
+	}
+	db.Model(&models.PodcastEpisode{}).Where("youtube_video_id = ?", youtubeVideoId).Updates(updates)
+}
+
+func UpdateEpisodeLiveStatus(youtubeVideoIds []string, liveStatus string) {
+	db.Model(&models.PodcastEpisode{}).Where("youtube_video_id IN ?", youtubeVideoIds).Update("live_status", liveStatus)
+}
+
+func UpdateEpisodeDetailsCheckedDate(youtubeVideoIds []string, checkedDate int64) {
+	db.Model(&models.PodcastEpisode{}).Where("youtube_video_id IN ?", youtubeVideoIds).UpdateColumn("details_checked_date", checkedDate)
+}
+
+func GetEpisodesWithoutPredictedSkip(podcastId string, limit int) ([]models.PodcastEpisode, error) {
+	var episodes []models.PodcastEpisode
+	err := db.Where("podcast_id = ? AND predicted_time_skipped IS NULL", podcastId).Order("published_date DESC").Limit(limit).Find(&episodes).Error
+	return episodes, err
+}
+
+func UpdateEpisodePredictedSkip(youtubeVideoId string, timeSkipped float64) {
+	db.Model(&models.PodcastEpisode{}).Where("youtube_video_id = ?", youtubeVideoId).Update("predicted_time_skipped", timeSkipped)
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+
+	log "github.com/labstack/gommon/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func GetDownloadJob(fileName string) *models.DownloadJob {
+	var job models.DownloadJob
+	err := db.Where("file_name = ?", fileName).Limit(1).Find(&job).Error
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if job.FileName == "" {
+		return nil
+	}
+	return &job
+}
+
+func GetDownloadJobs(status string) ([]models.DownloadJob, error) {
+	var jobs []models.DownloadJob
+	query := db.Order("updated_date DESC")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	err := query.Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Queue a download unless a worker is running it. A queued job only gains priority, and skips its retry backoff
+// when skipBackoff is set. Finished and failed jobs start over with fresh attempts. The conditional updates keep
+// a job claimed by a worker from being queued a second time.
+func QueueDownloadJob(fileName string, youtubeVideoId string, format string, priority int, skipBackoff bool, now int64) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{
+			"priority":     gorm.Expr("MAX(priority, ?)", priority),
+			"updated_date": now,
+		}
+		if skipBackoff {
+			updates["next_attempt_date"] = 0
+		}
+		result := tx.Model(&models.DownloadJob{}).
+			Where("file_name = ? AND status = ?", fileName, enum.QUEUED).
+			Updates(updates)
+		if result.Error != nil || result.RowsAffected > 0 {
+			return result.Error
+		}
+
+		result = tx.Model(&models.DownloadJob{}).
+			Where("file_name = ? AND status NOT IN ?", fileName, []enum.DownloadStatus{enum.QUEUED, enum.RUNNING}).
+			Updates(map[string]interface{}{
+				"status":            enum.QUEUED,
+				"priority":          priority,
+				"attempts":          0,
+				"next_attempt_date": 0,
+				"created_date":      now,
+				"updated_date":      now,
+			})
+		if result.Error != nil || result.RowsAffected > 0 {
+			return result.Error
+		}
+
+		// no job yet, or a worker is running it
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.DownloadJob{
+			FileName:       fileName,
+			YoutubeVideoId: youtubeVideoId,
+			Format:         format,
+			Status:         string(enum.QUEUED),
+			Priority:       priority,
+			CreatedDate:    now,
+			UpdatedDate:    now,
+		}).Error
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Queue a job again from scratch unless a worker is running it, returns false when there is no such job
+func RequeueDownloadJob(fileName string, now int64) (bool, error) {
+	err := db.Model(&models.DownloadJob{}).
+		Where("file_name = ? AND status <> ?", fileName, enum.RUNNING).
+		Updates(map[string]interface{}{
+			"status":            enum.QUEUED,
+			"attempts":          0,
+			"next_attempt_date": 0,
+			"updated_date":      now,
+		}).Error
+	if err != nil {
+		return false, err
+	}
+	return GetDownloadJob(fileName) != nil, nil
+}
+
+// Save the outcome of a download attempt. Only the columns of the attempt are written, so a priority raised
+// while the job ran is kept.
+func FinishDownloadJob(job *models.DownloadJob) {
+	err := db.Model(&models.DownloadJob{}).
+		Where("file_name = ? AND status = ?", job.FileName, enum.RUNNING).
+		Updates(map[string]interface{}{
+			"status":            job.Status,
+			"attempts":          job.Attempts,
+			"last_error":        job.LastError,
+			"next_attempt_date": job.NextAttemptDate,
+			"updated_date":      job.UpdatedDate,
+		}).Error
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Claim the next queued job that is due, marking it as running so no other worker picks it up
+func ClaimNextDownloadJob(now int64) *models.DownloadJob {
+	var job models.DownloadJob
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("status = ? AND next_attempt_date <= ?", enum.QUEUED, now).
+			Order("priority DESC, created_date").
+			Limit(1).
+			Find(&job).Error
+		if err != nil || job.FileName == "" {
+			return err
+		}
+
+		result := tx.Model(&models.DownloadJob{}).
+			Where("file_name = ? AND status = ?", job.FileName, enum.QUEUED).
+			Updates(map[string]interface{}{"status": enum.RUNNING, "updated_date": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			job = models.DownloadJob{}
+		}
+		job.Status = string(enum.RUNNING)
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if job.FileName == "" {
+		return nil
+	}
+	return &job
+}
+
+// Put jobs left running by a previous run of the app back in the queue
+func ResetRunningDownloadJobs() {
+	db.Model(&models.DownloadJob{}).
+		Where("status = ?", enum.RUNNING).
+		Update("status", enum.QUEUED)
+}
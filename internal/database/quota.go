@@ -0,0 +1,43 @@
+package database
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/models"
+
+	log "github.com/labstack/gommon/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Add the units of a call to the usage of the endpoint for the podcast on the given quota day
+func AddQuotaUsage(date string, endpoint string, podcastId string, units int) {
+	usage := models.QuotaUsage{Date: date, Endpoint: endpoint, PodcastId: podcastId, Units: units, Calls: 1}
+	err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "date"}, {Name: "endpoint"}, {Name: "podcast_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"units": gorm.Expr("units + ?", units),
+			"calls": gorm.Expr("calls + 1"),
+		}),
+	}).Create(&usage).Error
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Get the usage of every quota day since the given date, newest first
+func GetQuotaUsage(sinceDate string) ([]models.QuotaUsage, error) {
+	var usage []models.QuotaUsage
+	err := db.Where("date >= ?", sinceDate).Order("date DESC, units DESC").Find(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func GetQuotaUnitsUsed(date string) int {
+	var units int
+	err := db.Model(&models.QuotaUsage{}).Where("date = ?", date).Select("COALESCE(SUM(units), 0)").Scan(&units).Error
+	if err != nil {
+		log.Error(err)
+	}
+	return units
+}
@@ -45,4 +45,24 @@ func SetupDatabase() {
 	if err != nil {
 		panic(err)
 	}
+	err = db.AutoMigrate(&models.FeedSettings{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.AutoMigrate(&models.DownloadJob{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.AutoMigrate(&models.EpisodeChapters{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.AutoMigrate(&models.CustomFeedSource{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.AutoMigrate(&models.QuotaUsage{})
+	if err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,9 @@
+package enum
+
+type DownloadPhase string
+
+const (
+	DOWNLOADING     DownloadPhase = "DOWNLOADING"
+	SPONSORBLOCK    DownloadPhase = "SPONSORBLOCK"
+	POST_PROCESSING DownloadPhase = "POST_PROCESSING"
+)
@@ -0,0 +1,10 @@
+package enum
+
+type DownloadStatus string
+
+const (
+	QUEUED  DownloadStatus = "QUEUED"
+	RUNNING DownloadStatus = "RUNNING"
+	FAILED  DownloadStatus = "FAILED"
+	DONE    DownloadStatus = "DONE"
+)
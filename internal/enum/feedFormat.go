@@ -0,0 +1,9 @@
+package enum
+
+type FeedFormat string
+
+const (
+	RSS  FeedFormat = "RSS"
+	ATOM FeedFormat = "ATOM"
+	JSON FeedFormat = "JSON"
+)
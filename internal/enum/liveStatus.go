@@ -0,0 +1,14 @@
+package enum
+
+type LiveStatus string
+
+const (
+	NOT_LIVE LiveStatus = "NOT_LIVE"
+	// WAS_LIVE videos are recordings of a live stream or premiere
+	WAS_LIVE LiveStatus = "WAS_LIVE"
+	// IS_LIVE and IS_UPCOMING videos are streaming or scheduled and cannot be downloaded yet
+	IS_LIVE     LiveStatus = "IS_LIVE"
+	IS_UPCOMING LiveStatus = "IS_UPCOMING"
+	// UNAVAILABLE videos were streaming or scheduled and then removed before they could be downloaded
+	UNAVAILABLE LiveStatus = "UNAVAILABLE"
+)
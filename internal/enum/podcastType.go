@@ -5,4 +5,6 @@ type PodcastType string
 const (
 	PLAYLIST PodcastType = "PLAYLIST"
 	CHANNEL  PodcastType = "CHANNEL"
+	// CUSTOM podcasts merge the episodes of several channels and playlists
+	CUSTOM PodcastType = "CUSTOM"
 )
@@ -0,0 +1,8 @@
+package enum
+
+type SponsorBlockMode string
+
+const (
+	REMOVE SponsorBlockMode = "REMOVE"
+	MARK   SponsorBlockMode = "MARK"
+)
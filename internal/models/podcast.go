@@ -1,8 +1,11 @@
 package models
 
 import (
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"strings"
 	"time"
 
+	"github.com/lrstanley/go-ytdlp"
 	"google.golang.org/api/youtube/v3"
 )
 
@@ -15,10 +18,19 @@ type PodcastEpisode struct {
 	Type               string        `json:"type" gorm:"index:youtubevideoid_type_channelid_type"`
 	PodcastId          string        `json:"podcast_id" gorm:"foreignkey:PodcastId;association_foreignkey:Id"`
 	Duration           time.Duration `json:"duration"`
+	// seconds SponsorBlock is expected to cut, nil until looked up
+	PredictedTimeSkipped *float64 `json:"predicted_time_skipped"`
+	UpdatedDate          int64    `json:"updated_date" gorm:"autoUpdateTime"`
+	// one of enum.LiveStatus, empty when unknown
+	LiveStatus string `json:"live_status" gorm:"index"`
+	IsShort    bool   `json:"is_short"`
+	// when the video details were last looked up, videos that never return a duration are not looked up again
+	DetailsCheckedDate int64 `json:"details_checked_date"`
 }
 
 type Podcast struct {
 	Id              string           `json:"id" gorm:"primary_key"`
+	Type            string           `json:"type"`
 	AppleId         string           `json:"apple_id"`
 	PodcastName     string           `json:"podcast_name"`
 	Description     string           `json:"description"`
@@ -29,12 +41,96 @@ type Podcast struct {
 	PodcastEpisodes []PodcastEpisode `json:"podcast_episodes"`
 	ArtistName      string           `json:"artist_name"`
 	Explicit        string           `json:"explicit"`
+	FeedSettings    *FeedSettings    `json:"feed_settings,omitempty" gorm:"foreignKey:PodcastId"`
+	// channels and playlists merged into a CUSTOM podcast
+	Sources         []CustomFeedSource `json:"sources,omitempty" gorm:"foreignKey:CustomFeedId"`
+	LastRefreshDate int64              `json:"last_refresh_date"`
+	NextRefreshDate int64              `json:"next_refresh_date" gorm:"index"`
+	// uploads playlist of a CHANNEL podcast, episodes are read from it
+	UploadsPlaylistId string `json:"uploads_playlist_id"`
+	// when the podcast was last edited through the API, refreshes do not change it
+	UpdatedDate int64 `json:"updated_date"`
+	// when the content of the feed last changed, including removed episodes and finished downloads
+	ContentUpdatedDate int64 `json:"content_updated_date"`
+}
+
+// FeedSettings holds per feed overrides of the global env var settings.
+// Empty or nil fields fall back to the global value.
+type FeedSettings struct {
+	PodcastId              string `json:"podcast_id" gorm:"primary_key"`
+	SponsorBlockCategories string `json:"sponsorblock_categories"`
+	SponsorBlockMode       string `json:"sponsorblock_mode"`
+	MinDurationSeconds     *int   `json:"min_duration_seconds"`
+	TitleIncludeFilter     string `json:"title_include_filter"`
+	TitleExcludeFilter     string `json:"title_exclude_filter"`
+	CookiesFile            string `json:"cookies_file"`
+	RefreshIntervalMinutes *int   `json:"refresh_interval_minutes"`
+	PrefetchLatest         int    `json:"prefetch_latest"`
+	EpisodeLimit           *int   `json:"episode_limit"`
+	AudioFormat            string `json:"audio_format"`
+	AudioBitrate           string `json:"audio_bitrate"`
+	// episode filter rules, regular expressions use the Go RE2 syntax
+	TitleIncludeRegex       string `json:"title_include_regex"`
+	TitleExcludeRegex       string `json:"title_exclude_regex"`
+	DescriptionIncludeRegex string `json:"description_include_regex"`
+	DescriptionExcludeRegex string `json:"description_exclude_regex"`
+	MaxDurationSeconds      *int   `json:"max_duration_seconds"`
+	PublishedAfter          string `json:"published_after"`
+	ExcludeLiveStreams      bool   `json:"exclude_live_streams"`
+	ExcludeShorts           *bool  `json:"exclude_shorts"`
+	UpdatedDate             int64  `json:"updated_date"`
+}
+
+// CustomFeedSource links a CUSTOM podcast to one of the channels or playlists it merges
+type CustomFeedSource struct {
+	CustomFeedId string `json:"custom_feed_id" gorm:"primary_key"`
+	SourceId     string `json:"source_id" gorm:"primary_key;index"`
+	SourceType   string `json:"source_type"`
+}
+
+type DownloadJob struct {
+	FileName        string `json:"file_name" gorm:"primary_key"`
+	YoutubeVideoId  string `json:"youtube_video_id" gorm:"index"`
+	Format          string `json:"format"`
+	Status          string `json:"status" gorm:"index"`
+	Priority        int    `json:"priority"`
+	Attempts        int    `json:"attempts"`
+	NextAttemptDate int64  `json:"next_attempt_date"`
+	LastError       string `json:"last_error"`
+	CreatedDate     int64  `json:"created_date"`
+	UpdatedDate     int64  `json:"updated_date"`
+}
+
+// EpisodeChapters caches the YouTube chapters of a video as JSON encoded Chapter values
+type EpisodeChapters struct {
+	YoutubeVideoId string `json:"youtube_video_id" gorm:"primary_key"`
+	Chapters       string `json:"chapters"`
+	FetchedDate    int64  `json:"fetched_date"`
+}
+
+// Chapter follows the Podcasting 2.0 JSON chapters format
+type Chapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title"`
+}
+
+// QuotaUsage is the YouTube API quota spent on an endpoint for a podcast on one quota day.
+// Quota days start at midnight Pacific time.
+type QuotaUsage struct {
+	Date      string `json:"date" gorm:"primary_key"`
+	Endpoint  string `json:"endpoint" gorm:"primary_key"`
+	PodcastId string `json:"podcast_id" gorm:"primary_key"`
+	Units     int    `json:"units"`
+	Calls     int    `json:"calls"`
 }
 
 type EpisodePlaybackHistory struct {
 	YoutubeVideoId   string  `json:"youtube_video_id" gorm:"primary_key"`
 	LastAccessDate   int64   `json:"last_access_date"`
 	TotalTimeSkipped float64 `json:"total_time_skipped"`
+	// JSON encoded [start, end] ranges cut from the downloaded file, empty when unknown
+	RemovedSegments string `json:"removed_segments"`
 }
 
 func NewPodcastEpisodeFromPlaylist(youtubeVideo *youtube.PlaylistItem) PodcastEpisode {
@@ -57,5 +153,72 @@ func NewPodcastEpisodeFromSearch(youtubeVideo *youtube.Video, duration time.Dura
 		Type:               "CHANNEL",
 		PodcastId:          youtubeVideo.Snippet.ChannelId,
 		Duration:           duration,
+		LiveStatus:         string(GetVideoLiveStatus(youtubeVideo)),
+		IsShort:            IsShortVideo(youtubeVideo, duration),
+	}
+}
+
+// Get the live status from the snippet liveBroadcastContent, videos that were streamed or premiered
+// keep their live streaming details. Both parts have to be requested.
+func GetVideoLiveStatus(youtubeVideo *youtube.Video) enum.LiveStatus {
+	if youtubeVideo.Snippet != nil {
+		switch youtubeVideo.Snippet.LiveBroadcastContent {
+		case "live":
+			return enum.IS_LIVE
+		case "upcoming":
+			return enum.IS_UPCOMING
+		}
+	}
+	if youtubeVideo.LiveStreamingDetails != nil {
+		return enum.WAS_LIVE
+	}
+	return enum.NOT_LIVE
+}
+
+// Shorts are vertical and at most three minutes long. The player part sized with a max height gives the
+// aspect ratio of the video through its embed size.
+func IsShortVideo(youtubeVideo *youtube.Video, duration time.Duration) bool {
+	if youtubeVideo.Player == nil || youtubeVideo.Player.EmbedWidth == 0 {
+		return false
+	}
+	return duration > 0 && duration <= 3*time.Minute && youtubeVideo.Player.EmbedHeight > youtubeVideo.Player.EmbedWidth
+}
+
+func NewPodcastEpisodeFromYtdlp(entry *ytdlp.ExtractedInfo, podcastId string, episodeType string, publishedDate string) PodcastEpisode {
+	episode := PodcastEpisode{
+		YoutubeVideoId: entry.ID,
+		PublishedDate:  publishedDate,
+		Type:           episodeType,
+		PodcastId:      podcastId,
+	}
+	if entry.Title != nil {
+		episode.EpisodeName = *entry.Title
+	}
+	if entry.Description != nil {
+		episode.EpisodeDescription = *entry.Description
+	}
+	// flat playlist entries rarely include a description and feed items require one
+	if episode.EpisodeDescription == "" {
+		episode.EpisodeDescription = episode.EpisodeName
+	}
+	if entry.Duration != nil {
+		episode.Duration = time.Duration(*entry.Duration * float64(time.Second))
+	}
+	if entry.LiveStatus != nil {
+		switch *entry.LiveStatus {
+		case ytdlp.ExtractedLiveStatusWasLive, ytdlp.ExtractedLiveStatusPostLive:
+			episode.LiveStatus = string(enum.WAS_LIVE)
+		case ytdlp.ExtractedLiveStatusNotLive:
+			episode.LiveStatus = string(enum.NOT_LIVE)
+		case ytdlp.ExtractedLiveStatusIsLive:
+			episode.LiveStatus = string(enum.IS_LIVE)
+		case ytdlp.ExtractedLiveStatusIsUpcoming:
+			episode.LiveStatus = string(enum.IS_UPCOMING)
+		}
+	}
+	// flat playlist entries link Shorts through the shorts player
+	if entry.URL != nil && strings.Contains(*entry.URL, "/shorts/") {
+		episode.IsShort = true
 	}
+	return episode
 }
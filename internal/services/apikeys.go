@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/youtube/v3"
+)
+
+const youtubeClientTimeout = 30 * time.Second
+
+// Error reasons of a key that ran out of its daily quota
+var quotaExceededReasons = map[string]bool{
+	"quotaExceeded":      true,
+	"dailyLimitExceeded": true,
+}
+
+var errNoApiKey = errors.New("every Google API key is out of quota until the reset at midnight Pacific time")
+
+// apiKey is a Google API key, parked until the quota reset once it is out of quota
+type apiKey struct {
+	value       string
+	parkedUntil time.Time
+}
+
+var (
+	apiKeyPool     []*apiKey
+	apiKeyIndex    int
+	apiKeysMutex   sync.Mutex
+	apiKeysOnce    sync.Once
+	youtubeService *youtube.Service
+	youtubeOnce    sync.Once
+)
+
+// Get the shared YouTube client. Requests carry the key picked by callYoutube, so the client has none of its own.
+func setupYoutubeService() *youtube.Service {
+	youtubeOnce.Do(func() {
+		if len(getApiKeys()) == 0 {
+			log.Error("GOOGLE_API_KEY is not set")
+			return
+		}
+		service, err := youtube.NewService(context.Background(), option.WithHTTPClient(&http.Client{Timeout: youtubeClientTimeout}))
+		if err != nil {
+			log.Errorf("Error creating new YouTube client: %v", err)
+			return
+		}
+		youtubeService = service
+	})
+	return youtubeService
+}
+
+// Get the API keys from the comma separated GOOGLE_API_KEY and the GOOGLE_API_KEYS_FILE secrets file,
+// which has one key per line
+func getApiKeys() []*apiKey {
+	apiKeysOnce.Do(func() {
+		values := splitSetting(os.Getenv("GOOGLE_API_KEY"))
+		if path := strings.TrimSpace(os.Getenv("GOOGLE_API_KEYS_FILE")); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Errorf("Error reading GOOGLE_API_KEYS_FILE: %v", err)
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					values = append(values, splitSetting(line)...)
+				}
+			}
+		}
+
+		seen := map[string]bool{}
+		for _, value := range values {
+			if !seen[value] {
+				seen[value] = true
+				apiKeyPool = append(apiKeyPool, &apiKey{value: value})
+			}
+		}
+		if len(apiKeyPool) > 1 {
+			log.Infof("[QUOTA] Using %d Google API keys", len(apiKeyPool))
+		}
+	})
+	return apiKeyPool
+}
+
+// Get the key in use, moving on to the next key when it is parked
+func nextApiKey() (string, bool) {
+	keys := getApiKeys()
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+
+	now := time.Now()
+	for i := range keys {
+		index := (apiKeyIndex + i) % len(keys)
+		if now.After(keys[index].parkedUntil) {
+			apiKeyIndex = index
+			return keys[index].value, true
+		}
+	}
+	return "", false
+}
+
+func hasAvailableApiKey() bool {
+	_, ok := nextApiKey()
+	return ok
+}
+
+// Park the key until the quota resets at midnight Pacific time
+func parkApiKey(value string) {
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+
+	for _, key := range apiKeyPool {
+		if key.value == value {
+			key.parkedUntil = nextQuotaReset(time.Now())
+			log.Warnf("[QUOTA] Google API key %s is out of quota, parked until %s", maskApiKey(value), key.parkedUntil.Format(time.RFC3339))
+		}
+	}
+}
+
+func isQuotaExceeded(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if quotaExceededReasons[item.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+func maskApiKey(value string) string {
+	if len(value) <= 4 {
+		return "****"
+	}
+	return "****" + value[len(value)-4:]
+}
@@ -4,26 +4,17 @@ import (
 	"ikoyhn/podcast-sponsorblock/internal/database"
 	"ikoyhn/podcast-sponsorblock/internal/enum"
 	"math"
-	"os"
 
 	log "github.com/labstack/gommon/log"
 )
 
-func BuildChannelRssFeed(channelId string, host string) []byte {
+func BuildChannelRssFeed(channelId string, host string, options FeedOptions) (*Feed, error) {
 	log.Info("[RSS FEED] Building rss feed for channel...")
-	service := setupYoutubeService()
-
-	podcast := getChannelData(channelId, service, false)
-
-	getChannelMetadataAndVideos(podcast.Id, service)
-	episodes, err := database.GetPodcastEpisodesByPodcastId(podcast.Id)
+	podcast, err := getFeedPodcast(channelId, enum.CHANNEL)
 	if err != nil {
-		log.Error(err)
-		return nil
+		return nil, err
 	}
-
-	podcastRss := buildPodcast(podcast, episodes)
-	return GenerateRssFeed(podcastRss, host, enum.CHANNEL)
+	return getCachedFeed(podcast, host, enum.CHANNEL, options), nil
 }
 
 func DeterminePodcastDownload(youtubeVideoId string) (bool, float64) {
@@ -35,7 +26,7 @@ func DeterminePodcastDownload(youtubeVideoId string) (bool, float64) {
 	}
 
 	if math.Abs(episodeHistory.TotalTimeSkipped-updatedSkippedTime) > 2 {
-		os.Remove("/config/audio/" + youtubeVideoId + ".m4a")
+		removeMediaFiles(youtubeVideoId)
 		log.Debug("[SponsorBlock] Updating downloaded episode with new sponsor skips...")
 		return true, updatedSkippedTime
 	}
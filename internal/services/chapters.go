@@ -0,0 +1,271 @@
+package services
+
+import (
+	"encoding/json"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"math"
+	"sort"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+)
+
+const (
+	CHAPTERS_VERSION   = "1.2.0"
+	CHAPTERS_MIME_TYPE = "application/json+chapters"
+
+	// chapters are often added to the description after upload, so look them up again once a day
+	chaptersCacheDuration = 24 * time.Hour
+)
+
+// Chapter titles of the SponsorBlock categories, named like the chapters yt-dlp embeds
+var sponsorBlockCategoryNames = map[string]string{
+	"sponsor":        "Sponsor",
+	"selfpromo":      "Unpaid/Self Promotion",
+	"interaction":    "Interaction Reminder",
+	"intro":          "Intermission/Intro Animation",
+	"outro":          "Endcards/Credits",
+	"preview":        "Preview/Recap",
+	"music_offtopic": "Non-Music Section",
+	"filler":         "Filler Tangent",
+}
+
+// ChaptersResponse is a Podcasting 2.0 JSON chapters document
+type ChaptersResponse struct {
+	Version  string           `json:"version"`
+	Chapters []models.Chapter `json:"chapters"`
+}
+
+// Build the chapters of an episode from its YouTube chapters. When segments are removed the timestamps
+// are shifted to match the audio, in mark mode the segments become chapters of their own.
+func GetEpisodeChapters(youtubeVideoId string) ChaptersResponse {
+	chapters := getYoutubeChapters(youtubeVideoId)
+	if getSponsorBlockMode(database.GetFeedSettingsByVideoId(youtubeVideoId)) == enum.MARK {
+		segments, err := getSponsorBlockSegments(youtubeVideoId)
+		if err != nil {
+			log.Errorf("[CHAPTERS] Error looking up SponsorBlock segments of %s: %v", youtubeVideoId, err)
+		}
+		chapters = markChapters(chapters, segments)
+	} else if len(chapters) > 0 {
+		removed, err := getRemovedSegments(youtubeVideoId)
+		if err != nil {
+			log.Errorf("[CHAPTERS] Error looking up SponsorBlock segments of %s: %v", youtubeVideoId, err)
+		}
+		chapters = shiftChapters(chapters, removed)
+	}
+	return ChaptersResponse{Version: CHAPTERS_VERSION, Chapters: chapters}
+}
+
+func getYoutubeChapters(youtubeVideoId string) []models.Chapter {
+	cached := database.GetEpisodeChapters(youtubeVideoId)
+	if cached != nil && time.Since(time.Unix(cached.FetchedDate, 0)) < chaptersCacheDuration {
+		var chapters []models.Chapter
+		if err := json.Unmarshal([]byte(cached.Chapters), &chapters); err == nil {
+			return chapters
+		}
+	}
+
+	// failed lookups are cached as well, so every request does not run yt-dlp again
+	chapters, err := fetchYoutubeChapters(youtubeVideoId)
+	if err != nil {
+		log.Errorf("[CHAPTERS] Error looking up chapters of %s: %v", youtubeVideoId, err)
+		chapters = []models.Chapter{}
+	}
+	data, _ := json.Marshal(chapters)
+	database.SaveEpisodeChapters(&models.EpisodeChapters{
+		YoutubeVideoId: youtubeVideoId,
+		Chapters:       string(data),
+		FetchedDate:    time.Now().Unix(),
+	})
+	return chapters
+}
+
+func fetchYoutubeChapters(youtubeVideoId string) ([]models.Chapter, error) {
+	info, err := dumpVideo(youtubeVideoId)
+	if err != nil {
+		return nil, err
+	}
+
+	chapters := []models.Chapter{}
+	for _, chapter := range info.Chapters {
+		if chapter == nil || chapter.StartTime == nil {
+			continue
+		}
+		c := models.Chapter{StartTime: *chapter.StartTime}
+		if chapter.EndTime != nil {
+			c.EndTime = *chapter.EndTime
+		}
+		if chapter.Title != nil {
+			c.Title = *chapter.Title
+		}
+		chapters = append(chapters, c)
+	}
+	return chapters, nil
+}
+
+// Merge overlapping segments into ordered [start, end] ranges of removed time
+func mergeSegments(segments []SponsorBlockResponse) [][2]float64 {
+	merged := [][2]float64{}
+	for _, segment := range segments {
+		start, end := segment.Segment[0], segment.Segment[1]
+		if end <= start {
+			continue
+		}
+		if last := len(merged) - 1; last >= 0 && start <= merged[last][1] {
+			merged[last][1] = math.Max(merged[last][1], end)
+			continue
+		}
+		merged = append(merged, [2]float64{start, end})
+	}
+	return merged
+}
+
+// Get the ranges cut from the downloaded file of the video. Videos that were not downloaded yet, or were
+// downloaded before the ranges were recorded, use the current SponsorBlock segments.
+func getRemovedSegments(youtubeVideoId string) ([][2]float64, error) {
+	history := database.GetEpisodePlaybackHistory(youtubeVideoId)
+	if history.RemovedSegments != "" {
+		var removed [][2]float64
+		if err := json.Unmarshal([]byte(history.RemovedSegments), &removed); err == nil {
+			return removed, nil
+		}
+	}
+	segments, err := getSponsorBlockSegments(youtubeVideoId)
+	if err != nil {
+		return nil, err
+	}
+	return mergeSegments(segments), nil
+}
+
+// Look up the ranges yt-dlp is going to cut from the video, it looks up the segments before downloading.
+// Returns an empty string when the segments could not be looked up.
+func lookupRemovedSegments(youtubeVideoId string) string {
+	removed := [][2]float64{}
+	if getSponsorBlockMode(database.GetFeedSettingsByVideoId(youtubeVideoId)) == enum.REMOVE {
+		segments, err := getSponsorBlockSegments(youtubeVideoId)
+		if err != nil {
+			log.Error(err)
+			return ""
+		}
+		removed = mergeSegments(segments)
+	}
+	data, _ := json.Marshal(removed)
+	return string(data)
+}
+
+// Map a timestamp of the original video to the audio with the ranges removed
+func shiftTimestamp(t float64, removed [][2]float64) float64 {
+	shifted := t
+	for _, r := range removed {
+		if r[0] >= t {
+			break
+		}
+		shifted -= math.Min(t, r[1]) - r[0]
+	}
+	return math.Round(shifted*1000) / 1000
+}
+
+// Shift the chapters for the removed ranges, dropping chapters that were cut out entirely
+func shiftChapters(chapters []models.Chapter, removed [][2]float64) []models.Chapter {
+	shifted := make([]models.Chapter, 0, len(chapters))
+	for i, chapter := range chapters {
+		end := chapter.EndTime
+		if end == 0 && i+1 < len(chapters) {
+			end = chapters[i+1].StartTime
+		}
+
+		c := models.Chapter{Title: chapter.Title, StartTime: shiftTimestamp(chapter.StartTime, removed)}
+		if end > 0 {
+			c.EndTime = shiftTimestamp(end, removed)
+			if c.EndTime <= c.StartTime {
+				continue
+			}
+		}
+		shifted = append(shifted, c)
+	}
+	return shifted
+}
+
+// Split the YouTube chapters around the SponsorBlock segments, each segment becoming a chapter named by its category
+func markChapters(chapters []models.Chapter, segments []SponsorBlockResponse) []models.Chapter {
+	type span struct {
+		start float64
+		end   float64
+		title string
+	}
+
+	// segments are ordered by start time, trim overlaps so every moment belongs to one segment
+	sponsorSpans := []span{}
+	for _, segment := range segments {
+		start, end := segment.Segment[0], segment.Segment[1]
+		if last := len(sponsorSpans) - 1; last >= 0 && start < sponsorSpans[last].end {
+			start = sponsorSpans[last].end
+		}
+		if end <= start {
+			continue
+		}
+		sponsorSpans = append(sponsorSpans, span{start, end, sponsorBlockChapterTitle(segment.Category)})
+	}
+	if len(sponsorSpans) == 0 {
+		return chapters
+	}
+
+	boundaries := []float64{0}
+	for _, chapter := range chapters {
+		boundaries = append(boundaries, chapter.StartTime)
+	}
+	for _, s := range sponsorSpans {
+		boundaries = append(boundaries, s.start, s.end)
+	}
+	sort.Float64s(boundaries)
+
+	titleAt := func(t float64) (string, int) {
+		for i, s := range sponsorSpans {
+			if t >= s.start && t < s.end {
+				return s.title, -1 - i
+			}
+		}
+		for i := len(chapters) - 1; i >= 0; i-- {
+			if t >= chapters[i].StartTime {
+				return chapters[i].Title, i
+			}
+		}
+		return "", len(chapters)
+	}
+
+	marked := []models.Chapter{}
+	source := 0
+	for i, t := range boundaries {
+		if i > 0 && t == boundaries[i-1] {
+			continue
+		}
+		title, from := titleAt(t)
+		if len(marked) > 0 && from == source {
+			continue
+		}
+		if len(marked) > 0 {
+			marked[len(marked)-1].EndTime = t
+		}
+		marked = append(marked, models.Chapter{StartTime: t, Title: title})
+		source = from
+	}
+
+	// keep the end of the video when it is known
+	last := &marked[len(marked)-1]
+	if len(chapters) > 0 && chapters[len(chapters)-1].EndTime > last.StartTime {
+		last.EndTime = chapters[len(chapters)-1].EndTime
+	} else if sponsor := sponsorSpans[len(sponsorSpans)-1]; sponsor.end > last.StartTime {
+		last.EndTime = sponsor.end
+	}
+	return marked
+}
+
+func sponsorBlockChapterTitle(category string) string {
+	name, ok := sponsorBlockCategoryNames[category]
+	if !ok {
+		name = category
+	}
+	return "[SponsorBlock]: " + name
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"ikoyhn/podcast-sponsorblock/internal/common"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"strings"
+
+	log "github.com/labstack/gommon/log"
+)
+
+var ErrCustomFeedNotFound = errors.New("custom feed not found")
+
+func BuildCustomRssFeed(customFeedId string, host string, options FeedOptions) (*Feed, error) {
+	log.Debug("[RSS FEED] Building rss feed for custom feed...")
+
+	podcast := database.GetPodcast(customFeedId)
+	if podcast == nil || GetPodcastType(podcast) != enum.CUSTOM {
+		return nil, ErrCustomFeedNotFound
+	}
+	for _, source := range podcast.Sources {
+		if _, err := getFeedPodcast(source.SourceId, enum.PodcastType(source.SourceType)); err != nil {
+			log.Error("[RSS FEED] Source " + source.SourceId + " of custom feed " + customFeedId + ": " + err.Error())
+		}
+	}
+	return getCachedFeed(*podcast, host, enum.CUSTOM, options), nil
+}
+
+// Create a custom feed merging the episodes of the sources. Sources that are not saved yet are added first.
+// The artwork and author of the first source are used when the feed has none of its own.
+func AddCustomFeed(customFeed models.Podcast, sources []models.CustomFeedSource) (*models.Podcast, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("a custom feed needs at least one source")
+	}
+	if err := addCustomFeedSources(customFeed.Id, sources); err != nil {
+		return nil, err
+	}
+
+	customFeed.Type = string(enum.CUSTOM)
+	if customFeed.PodcastName == "" {
+		customFeed.PodcastName = customFeed.Id
+	}
+	if first := database.GetPodcast(sources[0].SourceId); first != nil {
+		if customFeed.ImageUrl == "" {
+			customFeed.ImageUrl = first.ImageUrl
+		}
+		if customFeed.ArtistName == "" {
+			customFeed.ArtistName = first.ArtistName
+		}
+		if customFeed.Category == "" {
+			customFeed.Category = first.Category
+		}
+	}
+	database.SavePodcast(&customFeed)
+	if err := UpdateCustomFeedSources(customFeed.Id, sources); err != nil {
+		return nil, err
+	}
+	markPodcastRefreshed(&customFeed)
+	return database.GetPodcast(customFeed.Id), nil
+}
+
+// Replace the sources of a custom feed, adding any sources that are not saved yet
+func UpdateCustomFeedSources(customFeedId string, sources []models.CustomFeedSource) error {
+	if err := addCustomFeedSources(customFeedId, sources); err != nil {
+		return err
+	}
+	for i := range sources {
+		sources[i].CustomFeedId = customFeedId
+	}
+	if err := database.SaveCustomFeedSources(customFeedId, sources); err != nil {
+		return err
+	}
+	InvalidateFeedCache(customFeedId)
+	return nil
+}
+
+// Check the sources and add the ones that are not saved yet. Saved sources have to be a channel or playlist
+// of the given type, so custom feeds cannot merge themselves or other custom feeds.
+func addCustomFeedSources(customFeedId string, sources []models.CustomFeedSource) error {
+	for i := range sources {
+		source := &sources[i]
+		source.SourceType = strings.ToUpper(source.SourceType)
+		sourceType := enum.PodcastType(source.SourceType)
+		if source.SourceId == "" || !common.IsValidID(source.SourceId) {
+			return fmt.Errorf("invalid source id %q", source.SourceId)
+		}
+		if sourceType != enum.CHANNEL && sourceType != enum.PLAYLIST {
+			return fmt.Errorf("unknown source type %q, use CHANNEL or PLAYLIST", source.SourceType)
+		}
+		if source.SourceId == customFeedId {
+			return errors.New("a custom feed cannot be a source of itself")
+		}
+		if sourcePodcast := database.GetPodcast(source.SourceId); sourcePodcast != nil {
+			if savedType := GetPodcastType(sourcePodcast); savedType != sourceType {
+				return fmt.Errorf("source %s is a %s, not a %s", source.SourceId, savedType, sourceType)
+			}
+			continue
+		}
+		if _, err := AddPodcast(source.SourceId, sourceType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the ids of the podcasts whose episodes are listed in the feed
+func getFeedPodcastIds(podcast models.Podcast) []string {
+	if GetPodcastType(&podcast) != enum.CUSTOM {
+		return []string{podcast.Id}
+	}
+	podcastIds := make([]string, 0, len(podcast.Sources))
+	for _, source := range podcast.Sources {
+		podcastIds = append(podcastIds, source.SourceId)
+	}
+	return podcastIds
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"errors"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+)
+
+const (
+	DOWNLOAD_PRIORITY_PREFETCH = 0
+	DOWNLOAD_PRIORITY_REQUEST  = 1
+
+	defaultDownloadWorkers     = 2
+	defaultDownloadMaxAttempts = 5
+	downloadRetryBaseDelay     = time.Minute
+	downloadRetryMaxDelay      = 6 * time.Hour
+	downloadPollInterval       = 30 * time.Second
+	stderrTailLines            = 20
+)
+
+var (
+	downloadWake         = make(chan struct{}, 1)
+	downloadWaiters      = map[string][]chan struct{}{}
+	downloadWaitersMutex sync.Mutex
+	downloadWorkersOnce  sync.Once
+)
+
+// Start the pool of workers that run the download jobs saved in the database.
+// The pool size is set with DOWNLOAD_WORKERS.
+func StartDownloadWorkers() {
+	downloadWorkersOnce.Do(func() {
+		database.ResetRunningDownloadJobs()
+
+		workers := getEnvInt("DOWNLOAD_WORKERS", defaultDownloadWorkers)
+		for i := 0; i < workers; i++ {
+			go downloadWorker()
+		}
+		log.Infof("[DOWNLOAD] Started %d download workers", workers)
+	})
+}
+
+func downloadWorker() {
+	ticker := time.NewTicker(downloadPollInterval)
+	defer ticker.Stop()
+	for {
+		job := database.ClaimNextDownloadJob(time.Now().Unix())
+		if job == nil {
+			select {
+			case <-downloadWake:
+			case <-ticker.C:
+			}
+			continue
+		}
+		// there may be more jobs waiting, let an idle worker check
+		wakeDownloadWorkers()
+		runDownloadJob(job)
+	}
+}
+
+func runDownloadJob(job *models.DownloadJob) {
+	log.Info("[DOWNLOAD] Downloading episode " + job.FileName)
+	job.Attempts++
+	removedSegments := lookupRemovedSegments(job.YoutubeVideoId)
+	var err error
+	if format, ok := GetMediaFormat(job.Format); ok {
+		err = downloadVideo(job.YoutubeVideoId, format)
+	} else {
+		err = errors.New("unknown media format " + job.Format)
+	}
+
+	now := time.Now()
+	job.UpdatedDate = now.Unix()
+	switch {
+	case err == nil:
+		job.Status = string(enum.DONE)
+		job.LastError = ""
+		job.NextAttemptDate = 0
+		database.UpdateEpisodePlaybackHistory(job.YoutubeVideoId, TotalSponsorTimeSkipped(job.YoutubeVideoId))
+		if removedSegments != "" {
+			database.UpdateEpisodeRemovedSegments(job.YoutubeVideoId, removedSegments)
+		}
+		InvalidateFeedCacheByVideoId(job.YoutubeVideoId)
+		log.Info("[DOWNLOAD] Finished downloading episode " + job.FileName)
+	case job.Attempts < getEnvInt("DOWNLOAD_MAX_ATTEMPTS", defaultDownloadMaxAttempts):
+		job.Status = string(enum.QUEUED)
+		job.LastError = err.Error()
+		job.NextAttemptDate = now.Add(downloadRetryDelay(job.Attempts)).Unix()
+		log.Errorf("[DOWNLOAD] Download of %s failed on attempt %d, retrying later: %v", job.FileName, job.Attempts, err)
+	default:
+		job.Status = string(enum.FAILED)
+		job.LastError = err.Error()
+		job.NextAttemptDate = 0
+		log.Errorf("[DOWNLOAD] Download of %s failed after %d attempts: %v", job.FileName, job.Attempts, err)
+	}
+	database.FinishDownloadJob(job)
+	finishDownloadProgress(job, enum.DownloadStatus(job.Status))
+	notifyDownloadWaiters(job.FileName)
+}
+
+// Add the video to the download queue. Requests from podcast clients skip any retry backoff and
+// jump ahead of prefetched episodes.
+func queueDownload(youtubeVideoId string, format MediaFormat, priority int) {
+	fileName := format.FileName(youtubeVideoId)
+	database.QueueDownloadJob(fileName, youtubeVideoId, format.Extension, priority, priority == DOWNLOAD_PRIORITY_REQUEST, time.Now().Unix())
+	wakeDownloadWorkers()
+}
+
+// Queue a download again from scratch, used to retry jobs that ran out of attempts
+func RetryDownload(fileName string) (*models.DownloadJob, error) {
+	found, err := database.RequeueDownloadJob(fileName, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("download job not found")
+	}
+	wakeDownloadWorkers()
+	return database.GetDownloadJob(fileName), nil
+}
+
+func wakeDownloadWorkers() {
+	select {
+	case downloadWake <- struct{}{}:
+	default:
+	}
+}
+
+// Register a channel to be closed when the next download attempt of the file finishes
+func waitForDownload(fileName string, done chan struct{}) {
+	downloadWaitersMutex.Lock()
+	defer downloadWaitersMutex.Unlock()
+	downloadWaiters[fileName] = append(downloadWaiters[fileName], done)
+}
+
+func notifyDownloadWaiters(fileName string) {
+	downloadWaitersMutex.Lock()
+	defer downloadWaitersMutex.Unlock()
+	for _, done := range downloadWaiters[fileName] {
+		close(done)
+	}
+	delete(downloadWaiters, fileName)
+}
+
+// Exponential backoff between attempts, capped at downloadRetryMaxDelay
+func downloadRetryDelay(attempts int) time.Duration {
+	delay := downloadRetryBaseDelay
+	for i := 1; i < attempts && delay < downloadRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > downloadRetryMaxDelay {
+		delay = downloadRetryMaxDelay
+	}
+	return delay
+}
+
+func stderrTail(stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if len(lines) > stderrTailLines {
+		lines = lines[len(lines)-stderrTailLines:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Errorf("Invalid %s %q, using default", key, value)
+		return defaultValue
+	}
+	return n
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+)
+
+const (
+	defaultFeedCacheTTL = 60 * time.Minute
+
+	// the host is part of the key, so cap the entries of a podcast to keep spoofed hosts from growing the cache
+	maxFeedCacheEntries = 64
+)
+
+type cachedFeed struct {
+	feed      *Feed
+	cacheDate time.Time
+}
+
+// podcastFeedCache holds the rendered feeds of one podcast. The generation is bumped on every invalidation
+// so a feed rendered from data that changed during the build is not stored.
+type podcastFeedCache struct {
+	generation uint64
+	feeds      map[string]cachedFeed
+}
+
+var (
+	feedCache      = map[string]*podcastFeedCache{}
+	feedCacheMutex sync.Mutex
+	feedBuildMutex sync.Map
+)
+
+// Get the rendered feed of a podcast from the cache, building it when missing. Concurrent requests
+// for the same podcast wait for a single build. The build lock is keyed by podcast only, so spoofed hosts
+// cannot grow it.
+func getCachedFeed(podcast models.Podcast, host string, podcastType enum.PodcastType, options FeedOptions) *Feed {
+	ttl := getEnvMinutes("FEED_CACHE_TTL", defaultFeedCacheTTL)
+	if ttl == 0 {
+		return renderFeed(podcast, host, podcastType, options)
+	}
+
+	key := feedCacheKey(host, options)
+	if feed := lookupFeed(podcast.Id, key, ttl); feed != nil {
+		return feed
+	}
+
+	mutex, _ := feedBuildMutex.LoadOrStore(podcast.Id, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	if feed := lookupFeed(podcast.Id, key, ttl); feed != nil {
+		return feed
+	}
+	generation := feedCacheGeneration(podcast.Id)
+	feed := renderFeed(podcast, host, podcastType, options)
+	if feed != nil {
+		storeFeed(podcast.Id, key, generation, feed)
+	}
+	return feed
+}
+
+func renderFeed(podcast models.Podcast, host string, podcastType enum.PodcastType, options FeedOptions) *Feed {
+	episodes, hasNextPage, err := getFeedEpisodes(podcast, podcastType, options)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	podcastRss := buildPodcast(podcast, episodes)
+	return GenerateRssFeed(podcastRss, host, podcastType, options, hasNextPage)
+}
+
+func feedCacheKey(host string, options FeedOptions) string {
+	return strings.Join([]string{
+		host,
+		string(options.MediaType),
+		string(options.Format),
+		strconv.Itoa(options.Limit),
+		options.Since,
+		strconv.Itoa(options.Page),
+	}, "|")
+}
+
+func lookupFeed(podcastId string, key string, ttl time.Duration) *Feed {
+	feedCacheMutex.Lock()
+	defer feedCacheMutex.Unlock()
+
+	cache, ok := feedCache[podcastId]
+	if !ok {
+		return nil
+	}
+	cached, ok := cache.feeds[key]
+	if !ok || time.Since(cached.cacheDate) > ttl {
+		return nil
+	}
+	log.Debug("[FEED CACHE] Serving cached feed for " + podcastId)
+	return cached.feed
+}
+
+func feedCacheGeneration(podcastId string) uint64 {
+	feedCacheMutex.Lock()
+	defer feedCacheMutex.Unlock()
+
+	if cache, ok := feedCache[podcastId]; ok {
+		return cache.generation
+	}
+	return 0
+}
+
+func storeFeed(podcastId string, key string, generation uint64, feed *Feed) {
+	feedCacheMutex.Lock()
+	defer feedCacheMutex.Unlock()
+
+	cache, ok := feedCache[podcastId]
+	if !ok {
+		cache = &podcastFeedCache{feeds: map[string]cachedFeed{}}
+		feedCache[podcastId] = cache
+	}
+	if cache.generation != generation {
+		return
+	}
+	if len(cache.feeds) >= maxFeedCacheEntries {
+		cache.feeds = map[string]cachedFeed{}
+	}
+	cache.feeds[key] = cachedFeed{feed: feed, cacheDate: time.Now()}
+}
+
+// Drop the rendered feeds of a podcast and the custom feeds merging it after its episodes, metadata or settings changed.
+// Their content date moves forward as well, so Last-Modified follows changes that remove episodes too.
+func InvalidateFeedCache(podcastId string) {
+	invalidateFeedCache(podcastId, true)
+}
+
+// Refreshes drop the rendered feeds every time but only move the content date when the episodes changed,
+// otherwise Last-Modified and the ETag would change on every refresh
+func invalidateFeedCache(podcastId string, contentChanged bool) {
+	podcastIds := append([]string{podcastId}, database.GetCustomFeedIdsBySource(podcastId)...)
+	for _, id := range podcastIds {
+		invalidatePodcastFeeds(id)
+	}
+	if contentChanged {
+		database.UpdatePodcastContentDates(podcastIds, time.Now().Unix())
+	}
+}
+
+func invalidatePodcastFeeds(podcastId string) {
+	feedCacheMutex.Lock()
+	defer feedCacheMutex.Unlock()
+
+	cache, ok := feedCache[podcastId]
+	if !ok {
+		cache = &podcastFeedCache{}
+		feedCache[podcastId] = cache
+	}
+	cache.generation++
+	cache.feeds = map[string]cachedFeed{}
+	log.Debug("[FEED CACHE] Invalidated feeds for " + podcastId)
+}
+
+// Drop the rendered feeds of every podcast the video is an episode of
+func InvalidateFeedCacheByVideoId(youtubeVideoId string) {
+	for _, podcastId := range database.GetEpisodePodcastIds(youtubeVideoId) {
+		InvalidateFeedCache(podcastId)
+	}
+}
+
+// Drop every rendered feed, used when media files are removed in bulk
+func ClearFeedCache() {
+	feedCacheMutex.Lock()
+	for _, cache := range feedCache {
+		cache.generation++
+		cache.feeds = map[string]cachedFeed{}
+	}
+	feedCacheMutex.Unlock()
+
+	database.UpdateAllPodcastContentDates(time.Now().Unix())
+	log.Debug("[FEED CACHE] Cleared all feeds")
+}
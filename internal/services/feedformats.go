@@ -0,0 +1,256 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"strings"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+)
+
+const (
+	ATOM_NS           = "http://www.w3.org/2005/Atom"
+	JSON_FEED_VERSION = "https://jsonfeed.org/version/1.1"
+)
+
+var feedContentTypes = map[enum.FeedFormat]string{
+	enum.RSS:  "application/rss+xml; charset=utf-8",
+	enum.ATOM: "application/atom+xml; charset=utf-8",
+	enum.JSON: "application/feed+json; charset=utf-8",
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"feed"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Id       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Link     []atomLink  `xml:"link"`
+	Author   *atomAuthor `xml:"author,omitempty"`
+	Icon     string      `xml:"icon,omitempty"`
+	Logo     string      `xml:"logo,omitempty"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Id        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published,omitempty"`
+	Link      []atomLink `xml:"link"`
+	Summary   *atomText  `xml:"summary,omitempty"`
+	Content   *atomText  `xml:"content,omitempty"`
+}
+
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageUrl string           `json:"home_page_url,omitempty"`
+	NextUrl     string           `json:"next_url,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Icon        string           `json:"icon,omitempty"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	Id            string               `json:"id"`
+	Url           string               `json:"url,omitempty"`
+	Title         string               `json:"title,omitempty"`
+	ContentHtml   string               `json:"content_html,omitempty"`
+	ContentText   string               `json:"content_text,omitempty"`
+	Image         string               `json:"image,omitempty"`
+	DatePublished string               `json:"date_published,omitempty"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAttachment struct {
+	Url               string `json:"url"`
+	MimeType          string `json:"mime_type"`
+	SizeInBytes       int64  `json:"size_in_bytes,omitempty"`
+	DurationInSeconds int64  `json:"duration_in_seconds,omitempty"`
+}
+
+// Parse the ?format= query param of a feed request, RSS when empty
+func parseFeedFormat(value string) (enum.FeedFormat, bool) {
+	format := enum.FeedFormat(strings.ToUpper(strings.TrimSpace(value)))
+	if format == "" {
+		return enum.RSS, true
+	}
+	_, ok := feedContentTypes[format]
+	return format, ok
+}
+
+func GetFeedContentType(format enum.FeedFormat) string {
+	return feedContentTypes[format]
+}
+
+func encodeFeed(p *Podcast, format enum.FeedFormat) []byte {
+	switch format {
+	case enum.ATOM:
+		return encodeAtomFeed(p)
+	case enum.JSON:
+		return encodeJsonFeed(p)
+	default:
+		return p.Bytes()
+	}
+}
+
+func encodeAtomFeed(p *Podcast) []byte {
+	feed := atomFeed{
+		Xmlns:    ATOM_NS,
+		Id:       p.Link,
+		Title:    p.Title,
+		Subtitle: p.Description,
+		Updated:  atomDate(p.LastBuildDate),
+		Link:     []atomLink{{Href: p.Link, Rel: "alternate"}},
+		Entries:  make([]atomEntry, 0, len(p.Items)),
+	}
+	if p.IAuthor != "" {
+		feed.Author = &atomAuthor{Name: p.IAuthor}
+	}
+	if p.Image != nil {
+		feed.Icon = p.Image.URL
+		feed.Logo = p.Image.URL
+	}
+	for _, link := range p.AtomLinks {
+		feed.Link = append(feed.Link, atomLink{Href: link.Href, Rel: link.Rel, Type: link.Type})
+	}
+
+	for _, item := range p.Items {
+		published := ""
+		if item.PubDate != nil && !item.PubDate.IsZero() {
+			published = item.PubDate.UTC().Format(time.RFC3339)
+		}
+		entry := atomEntry{
+			Id:        "urn:youtube:" + item.GUID.Value,
+			Title:     item.Title,
+			Updated:   published,
+			Published: published,
+		}
+		if entry.Updated == "" {
+			entry.Updated = feed.Updated
+		}
+		if item.Link != "" {
+			entry.Link = append(entry.Link, atomLink{Href: item.Link, Rel: "alternate"})
+		}
+		if item.Enclosure != nil {
+			entry.Link = append(entry.Link, atomLink{
+				Href:   item.Enclosure.URL,
+				Rel:    "enclosure",
+				Type:   item.Enclosure.Type.String(),
+				Length: item.Enclosure.Length,
+			})
+		}
+		if item.ISummary != nil {
+			entry.Summary = &atomText{Type: "text", Text: item.ISummary.Text}
+		}
+		if item.ContentEncoded != nil {
+			entry.Content = &atomText{Type: "html", Text: item.ContentEncoded.Text}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buffer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		log.Error(err)
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+func encodeJsonFeed(p *Podcast) []byte {
+	feed := jsonFeed{
+		Version:     JSON_FEED_VERSION,
+		Title:       p.Title,
+		HomePageUrl: p.Link,
+		Description: p.Description,
+		Items:       make([]jsonFeedItem, 0, len(p.Items)),
+	}
+	if p.IAuthor != "" {
+		feed.Authors = []jsonFeedAuthor{{Name: p.IAuthor}}
+	}
+	if p.Image != nil {
+		feed.Icon = p.Image.URL
+	}
+	for _, link := range p.AtomLinks {
+		if link.Rel == "next" {
+			feed.NextUrl = link.Href
+		}
+	}
+
+	for _, item := range p.Items {
+		feedItem := jsonFeedItem{
+			Id:    item.GUID.Value,
+			Url:   item.Link,
+			Title: item.Title,
+		}
+		if item.ContentEncoded != nil {
+			feedItem.ContentHtml = item.ContentEncoded.Text
+		}
+		if item.ISummary != nil {
+			feedItem.ContentText = item.ISummary.Text
+		}
+		if feedItem.ContentHtml == "" && feedItem.ContentText == "" {
+			// JSON Feed requires one of the content fields
+			feedItem.ContentText = item.Title
+		}
+		if item.IImage != nil {
+			feedItem.Image = item.IImage.HREF
+		}
+		if item.PubDate != nil && !item.PubDate.IsZero() {
+			feedItem.DatePublished = item.PubDate.UTC().Format(time.RFC3339)
+		}
+		if item.Enclosure != nil {
+			feedItem.Attachments = []jsonFeedAttachment{{
+				Url:               item.Enclosure.URL,
+				MimeType:          item.Enclosure.Type.String(),
+				SizeInBytes:       item.Enclosure.Length,
+				DurationInSeconds: item.DurationSeconds,
+			}}
+		}
+		feed.Items = append(feed.Items, feedItem)
+	}
+
+	data, err := json.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	return data
+}
+
+// Convert an RSS date to the RFC 3339 dates Atom uses
+func atomDate(rssDate string) string {
+	if t, err := time.Parse(time.RFC1123Z, rssDate); err == nil {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return time.Now().UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"errors"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+)
+
+// episodes are read in batches of this size while filling a page of the feed
+const feedEpisodeBatchSize = 500
+
+// FeedOptions are the query options of a feed request
+type FeedOptions struct {
+	MediaType enum.MediaType
+	Format    enum.FeedFormat
+	// Limit of 0 uses the episode_limit of the feed
+	Limit int
+	// Since is an RFC 3339 date in UTC, only episodes published since then are listed
+	Since string
+	// Page starts at 1 and only applies when the episodes are limited
+	Page int
+
+	// path of the request, used to link the other pages
+	Path string
+}
+
+// Read the format, limit, since and page query params of a feed request
+func ParseFeedOptions(path string, query url.Values, mediaType enum.MediaType) (FeedOptions, error) {
+	options := FeedOptions{MediaType: mediaType, Page: 1, Path: path}
+
+	format, ok := parseFeedFormat(query.Get("format"))
+	if !ok {
+		return options, errors.New("invalid feed format")
+	}
+	options.Format = format
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return options, errors.New("invalid limit")
+		}
+		options.Limit = limit
+	}
+
+	if value := query.Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page <= 0 {
+			return options, errors.New("invalid page")
+		}
+		options.Page = page
+	}
+
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			since, err = time.Parse(time.DateOnly, value)
+		}
+		if err != nil {
+			return options, errors.New("invalid since date, use RFC 3339 or YYYY-MM-DD")
+		}
+		options.Since = since.UTC().Format(time.RFC3339)
+	}
+	return options, nil
+}
+
+// Get the page of episodes for the feed and whether there are more after it. The filter rules of the feed
+// are applied before paging, so the episodes are read in batches until the page is full.
+func getFeedEpisodes(podcast models.Podcast, podcastType enum.PodcastType, options FeedOptions) ([]models.PodcastEpisode, bool, error) {
+	podcastIds := getFeedPodcastIds(podcast)
+	settings := database.GetFeedSettings(podcast.Id)
+	limit := options.Limit
+	if limit == 0 {
+		limit = getEpisodeLimit(settings)
+	}
+	skip := 0
+	if limit > 0 {
+		skip = (options.Page - 1) * limit
+	}
+
+	episodes := []models.PodcastEpisode{}
+	for offset := 0; ; offset += feedEpisodeBatchSize {
+		batch, err := database.GetPodcastEpisodesPage(podcastIds, options.Since, feedEpisodeBatchSize, offset)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, episode := range batch {
+			if isEpisodeFiltered(settings, podcastType, episode) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			// an episode past the limit means there is a next page
+			if limit > 0 && len(episodes) == limit {
+				return episodes, true, nil
+			}
+			episodes = append(episodes, episode)
+		}
+		if len(batch) < feedEpisodeBatchSize {
+			return episodes, false, nil
+		}
+	}
+}
+
+// Get the default number of episodes in a feed, the feed override wins over FEED_EPISODE_LIMIT. 0 lists every episode.
+func getEpisodeLimit(settings *models.FeedSettings) int {
+	if settings != nil && settings.EpisodeLimit != nil && *settings.EpisodeLimit >= 0 {
+		return *settings.EpisodeLimit
+	}
+	value := os.Getenv("FEED_EPISODE_LIMIT")
+	if value == "" {
+		return 0
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		log.Errorf("Invalid FEED_EPISODE_LIMIT %q, listing every episode", value)
+		return 0
+	}
+	return limit
+}
+
+// Build the RFC 5005 links to the first, previous and next pages of the feed
+func getPageLinks(host string, options FeedOptions, hasNextPage bool) []*AtomLink {
+	if options.Page <= 1 && !hasNextPage {
+		return nil
+	}
+	contentType := GetFeedContentType(options.Format)
+	links := []*AtomLink{{Href: pageUrl(host, options, 1), Rel: "first", Type: contentType}}
+	if options.Page > 1 {
+		links = append(links, &AtomLink{Href: pageUrl(host, options, options.Page-1), Rel: "previous", Type: contentType})
+	}
+	if hasNextPage {
+		links = append(links, &AtomLink{Href: pageUrl(host, options, options.Page+1), Rel: "next", Type: contentType})
+	}
+	return links
+}
+
+// Page links only carry the parsed options, the same ones the feed cache is keyed by, so the params
+// of one request never end up in the cached feed served to others
+func pageUrl(host string, options FeedOptions, page int) string {
+	query := url.Values{}
+	if options.Format != enum.RSS {
+		query.Set("format", strings.ToLower(string(options.Format)))
+	}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.Since != "" {
+		query.Set("since", options.Since)
+	}
+	if token := os.Getenv("TOKEN"); token != "" {
+		query.Set("token", token)
+	}
+	if page > 1 {
+		query.Set("page", strconv.Itoa(page))
+	}
+	if len(query) == 0 {
+		return host + options.Path
+	}
+	return host + options.Path + "?" + query.Encode()
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"fmt"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+)
+
+// compiled filter patterns, invalid patterns are stored as nil so they are only reported once
+var filterPatterns sync.Map
+
+// Check the episode against the filter rules of the feed. Every episode is saved, even the ones the rules reject,
+// so the rules are applied when the feed is built and before prefetching, custom feeds apply their own.
+func isEpisodeFiltered(settings *models.FeedSettings, podcastType enum.PodcastType, episode models.PodcastEpisode) bool {
+	if episode.EpisodeName == "Private video" || episode.EpisodeDescription == "This video is private." {
+		return true
+	}
+	if episode.Duration > 0 && episode.Duration < getMinDuration(settings, podcastType) {
+		return true
+	}
+	if episode.IsShort && getExcludeShorts(settings, podcastType) {
+		return true
+	}
+	if isTitleFiltered(settings, episode.EpisodeName) {
+		return true
+	}
+	if settings == nil {
+		return false
+	}
+
+	if settings.MaxDurationSeconds != nil && *settings.MaxDurationSeconds > 0 && episode.Duration > time.Duration(*settings.MaxDurationSeconds)*time.Second {
+		return true
+	}
+	if settings.ExcludeLiveStreams && episode.LiveStatus == string(enum.WAS_LIVE) {
+		return true
+	}
+	if publishedAfter, ok := parseFilterDate(settings.PublishedAfter); ok {
+		if published, err := time.Parse(time.RFC3339, episode.PublishedDate); err == nil && published.Before(publishedAfter) {
+			return true
+		}
+	}
+	return !matchesFilter(settings.TitleIncludeRegex, episode.EpisodeName, true) ||
+		matchesFilter(settings.TitleExcludeRegex, episode.EpisodeName, false) ||
+		!matchesFilter(settings.DescriptionIncludeRegex, episode.EpisodeDescription, true) ||
+		matchesFilter(settings.DescriptionExcludeRegex, episode.EpisodeDescription, false)
+}
+
+// Match the text against the pattern, an empty or invalid pattern gives the fallback
+func matchesFilter(pattern string, text string, fallback bool) bool {
+	if pattern == "" {
+		return fallback
+	}
+	re := getFilterPattern(pattern)
+	if re == nil {
+		return fallback
+	}
+	return re.MatchString(text)
+}
+
+func getFilterPattern(pattern string) *regexp.Regexp {
+	if re, ok := filterPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Errorf("[FILTER] Ignoring invalid filter pattern %q: %v", pattern, err)
+		re = nil
+	}
+	filterPatterns.Store(pattern, re)
+	return re
+}
+
+func parseFilterDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// Check the filter rules of feed settings sent through the API
+func ValidateFeedSettings(settings *models.FeedSettings, podcastType enum.PodcastType) error {
+	patterns := map[string]string{
+		"title_include_regex":       settings.TitleIncludeRegex,
+		"title_exclude_regex":       settings.TitleExcludeRegex,
+		"description_include_regex": settings.DescriptionIncludeRegex,
+		"description_exclude_regex": settings.DescriptionExcludeRegex,
+	}
+	for name, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	if _, ok := parseFilterDate(settings.PublishedAfter); settings.PublishedAfter != "" && !ok {
+		return fmt.Errorf("invalid published_after %q, use RFC 3339 or YYYY-MM-DD", settings.PublishedAfter)
+	}
+	numbers := []struct {
+		name  string
+		value *int
+	}{
+		{"max_duration_seconds", settings.MaxDurationSeconds},
+		{"min_duration_seconds", settings.MinDurationSeconds},
+		{"refresh_interval_minutes", settings.RefreshIntervalMinutes},
+		{"episode_limit", settings.EpisodeLimit},
+		{"prefetch_latest", &settings.PrefetchLatest},
+	}
+	for _, number := range numbers {
+		if number.value != nil && *number.value < 0 {
+			return fmt.Errorf("invalid %s %d", number.name, *number.value)
+		}
+	}
+	switch mode := enum.SponsorBlockMode(strings.ToUpper(strings.TrimSpace(settings.SponsorBlockMode))); mode {
+	case "", enum.REMOVE, enum.MARK:
+	default:
+		return fmt.Errorf("invalid sponsorblock_mode %q, use REMOVE or MARK", settings.SponsorBlockMode)
+	}
+	if value := strings.TrimSpace(settings.AudioFormat); value != "" {
+		if format, ok := GetMediaFormat(value); !ok || format.MediaType != enum.AUDIO {
+			return fmt.Errorf("invalid audio_format %q, use m4a, mp3 or opus", settings.AudioFormat)
+		}
+	}
+	if value := strings.TrimSpace(settings.AudioBitrate); value != "" && !audioBitratePattern.MatchString(value) {
+		return fmt.Errorf("invalid audio_bitrate %q, use a quality from 0 to 10 or a bitrate such as 128K", settings.AudioBitrate)
+	}
+	for _, category := range splitSetting(settings.SponsorBlockCategories) {
+		if _, ok := sponsorBlockCategoryNames[category]; !ok {
+			return fmt.Errorf("unknown sponsorblock category %q", category)
+		}
+	}
+	if podcastType == enum.CUSTOM {
+		// the episodes of a custom feed are downloaded with the settings of the source they belong to
+		downloadSettings := []struct {
+			name string
+			set  bool
+		}{
+			{"sponsorblock_categories", strings.TrimSpace(settings.SponsorBlockCategories) != ""},
+			{"sponsorblock_mode", strings.TrimSpace(settings.SponsorBlockMode) != ""},
+			{"audio_format", strings.TrimSpace(settings.AudioFormat) != ""},
+			{"audio_bitrate", strings.TrimSpace(settings.AudioBitrate) != ""},
+			{"cookies_file", strings.TrimSpace(settings.CookiesFile) != ""},
+			{"prefetch_latest", settings.PrefetchLatest != 0},
+		}
+		for _, setting := range downloadSettings {
+			if setting.set {
+				return fmt.Errorf("%s cannot be set on a custom feed, set it on its sources", setting.name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/labstack/gommon/log"
+)
+
+const mediaDir = "/config/audio"
+
+// MediaFormat is an output format episodes can be downloaded in
+type MediaFormat struct {
+	Extension     string
+	EnclosureType EnclosureType
+	MediaType     enum.MediaType
+}
+
+var (
+	AUDIO_M4A  = MediaFormat{Extension: "m4a", EnclosureType: M4A, MediaType: enum.AUDIO}
+	AUDIO_MP3  = MediaFormat{Extension: "mp3", EnclosureType: MP3, MediaType: enum.AUDIO}
+	AUDIO_OPUS = MediaFormat{Extension: "opus", EnclosureType: OPUS, MediaType: enum.AUDIO}
+	VIDEO_MP4  = MediaFormat{Extension: "mp4", EnclosureType: MP4, MediaType: enum.VIDEO}
+)
+
+var mediaFormats = map[string]MediaFormat{
+	AUDIO_M4A.Extension:  AUDIO_M4A,
+	AUDIO_MP3.Extension:  AUDIO_MP3,
+	AUDIO_OPUS.Extension: AUDIO_OPUS,
+	VIDEO_MP4.Extension:  VIDEO_MP4,
+}
+
+func GetMediaFormat(extension string) (MediaFormat, bool) {
+	format, ok := mediaFormats[strings.ToLower(strings.TrimPrefix(extension, "."))]
+	return format, ok
+}
+
+// Split a media file name such as abc123.m4a into the video id and its format
+func ParseMediaFileName(fileName string) (string, MediaFormat, bool) {
+	ext := filepath.Ext(fileName)
+	format, ok := GetMediaFormat(ext)
+	if !ok {
+		return "", MediaFormat{}, false
+	}
+	return strings.TrimSuffix(fileName, ext), format, true
+}
+
+func (f MediaFormat) FileName(youtubeVideoId string) string {
+	return youtubeVideoId + "." + f.Extension
+}
+
+func (f MediaFormat) FilePath(youtubeVideoId string) string {
+	return filepath.Join(mediaDir, f.FileName(youtubeVideoId))
+}
+
+// Get the format episodes of a feed are served in, audio feeds use the audio_format setting
+func getFeedMediaFormat(settings *models.FeedSettings, mediaType enum.MediaType) MediaFormat {
+	if mediaType == enum.VIDEO {
+		return VIDEO_MP4
+	}
+	return getAudioFormat(settings)
+}
+
+// Remove the downloaded files of the video in every format
+func removeMediaFiles(youtubeVideoId string) {
+	for _, format := range mediaFormats {
+		os.Remove(format.FilePath(youtubeVideoId))
+	}
+}
+
+// Remove the downloaded files of every episode of the podcast, along with the segments that were cut from them
+func removePodcastMediaFiles(podcastId string) {
+	episodes, err := database.GetPodcastEpisodesByPodcastId(podcastId)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, episode := range episodes {
+		removeMediaFiles(episode.YoutubeVideoId)
+		database.UpdateEpisodeRemovedSegments(episode.YoutubeVideoId, "")
+	}
+	log.Info("[MEDIA] Removed downloaded episodes of " + podcastId + " after its settings changed")
+}
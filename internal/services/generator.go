@@ -31,6 +31,7 @@ const (
 	MOV
 	PDF
 	EPUB
+	OPUS
 )
 
 const (
@@ -58,6 +59,8 @@ func (et EnclosureType) String() string {
 		return "application/pdf"
 	case EPUB:
 		return "document/x-epub"
+	case OPUS:
+		return "audio/ogg"
 	}
 	return enclosureDefault
 }
@@ -136,15 +139,42 @@ type Item struct {
 	PubDate          *time.Time `xml:"-"`
 	PubDateFormatted string     `xml:"pubDate,omitempty"`
 	Enclosure        *Enclosure
+	ContentEncoded   *ContentEncoded
 
 	// https://help.apple.com/itc/podcasts_connect/#/itcb54353390
 	IAuthor            string `xml:"itunes:author,omitempty"`
 	ISubtitle          string `xml:"itunes:subtitle,omitempty"`
 	ISummary           *ISummary
+	IImage             *IImage
 	IDuration          string `xml:"itunes:duration,omitempty"`
+	DurationSeconds    int64  `xml:"-"`
 	IExplicit          string `xml:"itunes:explicit,omitempty"`
 	IIsClosedCaptioned string `xml:"itunes:isClosedCaptioned,omitempty"`
 	IOrder             string `xml:"itunes:order,omitempty"`
+	IEpisodeType       string `xml:"itunes:episodeType,omitempty"`
+	ISeason            string `xml:"itunes:season,omitempty"`
+	IEpisode           string `xml:"itunes:episode,omitempty"`
+
+	// https://podcastindex.org/namespace/1.0#chapters
+	Chapters *Chapters
+	// https://podcastindex.org/namespace/1.0#transcript
+	Transcripts []Transcript
+}
+
+// Transcript links an Item to a transcript or closed captions file.
+type Transcript struct {
+	XMLName  xml.Name `xml:"podcast:transcript"`
+	URL      string   `xml:"url,attr"`
+	Type     string   `xml:"type,attr"`
+	Language string   `xml:"language,attr,omitempty"`
+	Rel      string   `xml:"rel,attr,omitempty"`
+}
+
+// Chapters links an Item to its Podcasting 2.0 JSON chapters.
+type Chapters struct {
+	XMLName xml.Name `xml:"podcast:chapters"`
+	URL     string   `xml:"url,attr"`
+	Type    string   `xml:"type,attr"`
 }
 
 // AddEnclosure adds the downloadable asset to the podcast Item.
@@ -207,6 +237,18 @@ type ISummary struct {
 	Text    string   `xml:",cdata"`
 }
 
+// IImage represents an iTunes image.
+type IImage struct {
+	XMLName xml.Name `xml:"itunes:image"`
+	HREF    string   `xml:"href,attr"`
+}
+
+// ContentEncoded represents rich HTML content of an Item.
+type ContentEncoded struct {
+	XMLName xml.Name `xml:"content:encoded"`
+	Text    string   `xml:",cdata"`
+}
+
 // Podcast represents a podcast.
 type Podcast struct {
 	XMLName        xml.Name `xml:"channel"`
@@ -229,6 +271,7 @@ type Podcast struct {
 	WebMaster      string   `xml:"webMaster,omitempty"`
 	Image          *Image
 	TextInput      *TextInput
+	AtomLinks      []*AtomLink
 
 	// https://help.apple.com/itc/podcasts_connect/#/itcb54353390
 	IAuthor     string `xml:"itunes:author,omitempty"`
@@ -247,6 +290,14 @@ type Podcast struct {
 	encode func(w io.Writer, o interface{}) error
 }
 
+// AtomLink represents an atom:link, used for RFC 5005 feed paging.
+type AtomLink struct {
+	XMLName xml.Name `xml:"atom:link"`
+	Href    string   `xml:"href,attr"`
+	Rel     string   `xml:"rel,attr"`
+	Type    string   `xml:"type,attr,omitempty"`
+}
+
 // TextInput represents text inputs.
 type TextInput struct {
 	XMLName     xml.Name `xml:"textInput"`
@@ -556,6 +607,7 @@ func (p *Podcast) Encode(w io.Writer) error {
 		ITUNESNS:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
 		ATOMNS:    "http://www.w3.org/2005/Atom",
 		CONTENTNS: "http://purl.org/rss/1.0/modules/content/",
+		PODCASTNS: "https://podcastindex.org/namespace/1.0",
 		Channel:   p,
 	}
 	return p.encode(w, wrapped)
@@ -586,6 +638,7 @@ type podcastWrapper struct {
 	ATOMNS    string   `xml:"xmlns:atom,attr,omitempty"`
 	ITUNESNS  string   `xml:"xmlns:itunes,attr"`
 	CONTENTNS string   `xml:"xmlns:content,attr"`
+	PODCASTNS string   `xml:"xmlns:podcast,attr"`
 	Channel   *Podcast
 }
 
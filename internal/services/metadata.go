@@ -0,0 +1,78 @@
+package services
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"os"
+	"strings"
+
+	log "github.com/labstack/gommon/log"
+	"google.golang.org/api/youtube/v3"
+)
+
+const (
+	METADATA_PROVIDER_YOUTUBE = "youtube"
+	METADATA_PROVIDER_YTDLP   = "ytdlp"
+)
+
+// MetadataProvider is the source used to look up podcast and episode metadata
+// for the RSS feeds.
+type MetadataProvider interface {
+	// GetChannelData returns the podcast for a channel or playlist, creating it in the database if needed.
+	GetChannelData(channelIdentifier string, isPlaylist bool) models.Podcast
+	// GetPlaylistEpisodes saves any playlist episodes not yet in the database.
+	GetPlaylistEpisodes(youtubePlaylistId string)
+	// GetChannelEpisodes saves any channel episodes not yet in the database.
+	GetChannelEpisodes(channelId string)
+}
+
+// youtubeApiProvider looks up metadata through the YouTube Data API v3
+type youtubeApiProvider struct {
+	service *youtube.Service
+}
+
+func (p *youtubeApiProvider) GetChannelData(channelIdentifier string, isPlaylist bool) models.Podcast {
+	quota := newQuotaRun(channelIdentifier)
+	defer quota.logUsage()
+	return getChannelData(channelIdentifier, p.service, isPlaylist, quota)
+}
+
+func (p *youtubeApiProvider) GetPlaylistEpisodes(youtubePlaylistId string) {
+	quota := newQuotaRun(youtubePlaylistId)
+	defer quota.logUsage()
+	getYoutubePlaylistData(youtubePlaylistId, p.service, quota)
+	refreshEpisodeVideoDetails(youtubePlaylistId, p.service, quota)
+}
+
+func (p *youtubeApiProvider) GetChannelEpisodes(channelId string) {
+	quota := newQuotaRun(channelId)
+	defer quota.logUsage()
+	getChannelMetadataAndVideos(channelId, p.service, quota)
+	refreshEpisodeVideoDetails(channelId, p.service, quota)
+}
+
+// Pick the metadata provider from METADATA_PROVIDER, falling back to yt-dlp when no Google API key is set
+func getMetadataProvider() MetadataProvider {
+	provider := strings.ToLower(strings.TrimSpace(os.Getenv("METADATA_PROVIDER")))
+	if provider == "" {
+		provider = METADATA_PROVIDER_YOUTUBE
+		if len(getApiKeys()) == 0 {
+			provider = METADATA_PROVIDER_YTDLP
+		}
+	}
+
+	switch provider {
+	case METADATA_PROVIDER_YTDLP:
+		log.Debug("[METADATA] Using yt-dlp metadata provider")
+		return &ytdlpProvider{}
+	case METADATA_PROVIDER_YOUTUBE:
+		service := setupYoutubeService()
+		if service == nil {
+			log.Warn("[METADATA] YouTube API unavailable, falling back to yt-dlp metadata provider")
+			return &ytdlpProvider{}
+		}
+		return &youtubeApiProvider{service: service}
+	default:
+		log.Errorf("[METADATA] Unknown METADATA_PROVIDER %q, using yt-dlp", provider)
+		return &ytdlpProvider{}
+	}
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+
+	log "github.com/labstack/gommon/log"
+)
+
+const placeholderAudioPath = "/config/placeholder.m4a"
+
+var placeholderMutex sync.Mutex
+
+// Get the path of the clip served while an episode is still downloading. A few seconds of silence
+// is generated with ffmpeg the first time, replace the file in the config folder to use your own clip.
+func GetPlaceholderAudio() (string, error) {
+	placeholderMutex.Lock()
+	defer placeholderMutex.Unlock()
+
+	if _, err := os.Stat(placeholderAudioPath); err == nil {
+		return placeholderAudioPath, nil
+	}
+
+	log.Info("[MEDIA] Generating placeholder audio...")
+	cmd := exec.Command("/usr/bin/ffmpeg",
+		"-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "anullsrc=r=44100:cl=mono",
+		"-t", "5",
+		"-c:a", "aac", "-b:a", "32k",
+		"-y", placeholderAudioPath,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Errorf("Error generating placeholder audio: %v %s", err, output)
+		os.Remove(placeholderAudioPath)
+		return "", err
+	}
+	return placeholderAudioPath, nil
+}
@@ -1,28 +1,20 @@
 package services
 
 import (
-	"ikoyhn/podcast-sponsorblock/internal/database"
 	"ikoyhn/podcast-sponsorblock/internal/enum"
 	"ikoyhn/podcast-sponsorblock/internal/models"
 
 	log "github.com/labstack/gommon/log"
 )
 
-func BuildPlaylistRssFeed(youtubePlaylistId string, host string) []byte {
+func BuildPlaylistRssFeed(youtubePlaylistId string, host string, options FeedOptions) (*Feed, error) {
 	log.Debug("[RSS FEED] Building rss feed for playlist...")
 
-	service := setupYoutubeService()
-	podcast := getChannelData(youtubePlaylistId, service, true)
-
-	getYoutubePlaylistData(youtubePlaylistId, service)
-	episodes, err := database.GetPodcastEpisodesByPodcastId(youtubePlaylistId)
+	podcast, err := getFeedPodcast(youtubePlaylistId, enum.PLAYLIST)
 	if err != nil {
-		log.Error(err)
-		return nil
+		return nil, err
 	}
-
-	podcastRss := buildPodcast(podcast, episodes)
-	return GenerateRssFeed(podcastRss, host, enum.PLAYLIST)
+	return getCachedFeed(podcast, host, enum.PLAYLIST, options), nil
 }
 
 func buildPodcast(podcast models.Podcast, allItems []models.PodcastEpisode) models.Podcast {
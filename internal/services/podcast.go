@@ -0,0 +1,110 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"strings"
+
+	log "github.com/labstack/gommon/log"
+)
+
+var ErrPodcastNotFound = errors.New("podcast not found")
+
+// Register a channel or playlist and pull in its episodes without waiting for a podcast client
+func AddPodcast(podcastId string, podcastType enum.PodcastType) (*models.Podcast, error) {
+	if podcastType != enum.CHANNEL && podcastType != enum.PLAYLIST {
+		return nil, fmt.Errorf("unknown podcast type %q", podcastType)
+	}
+
+	provider := getMetadataProvider()
+	provider.GetChannelData(podcastId, podcastType == enum.PLAYLIST)
+	podcast := database.GetPodcast(podcastId)
+	if podcast == nil {
+		return nil, fmt.Errorf("podcast %s could not be found on YouTube", podcastId)
+	}
+
+	refreshEpisodes(provider, podcast)
+	markPodcastRefreshed(podcast)
+	return podcast, nil
+}
+
+// Look up any new episodes for an already registered podcast
+func RefreshPodcast(podcastId string) error {
+	podcast := database.GetPodcast(podcastId)
+	if podcast == nil {
+		return fmt.Errorf("podcast %s not found", podcastId)
+	}
+
+	provider := getMetadataProvider()
+	for _, source := range podcast.Sources {
+		if sourcePodcast := database.GetPodcast(source.SourceId); sourcePodcast != nil {
+			refreshEpisodes(provider, sourcePodcast)
+			markPodcastRefreshed(sourcePodcast)
+		}
+	}
+	refreshEpisodes(provider, podcast)
+	markPodcastRefreshed(podcast)
+	return nil
+}
+
+// Get the podcast for a feed request, looking up new episodes unless the background refresher keeps it up to date.
+// Ids that are neither saved nor found on YouTube return ErrPodcastNotFound.
+func getFeedPodcast(podcastId string, podcastType enum.PodcastType) (models.Podcast, error) {
+	dbPodcast := database.GetPodcast(podcastId)
+	if !shouldRefreshOnRequest(dbPodcast) {
+		return *dbPodcast, nil
+	}
+
+	provider := getMetadataProvider()
+	if dbPodcast != nil && isQuotaDeferred(provider) {
+		log.Info("[QUOTA] Daily budget reached, serving " + podcastId + " without looking up new episodes")
+		return *dbPodcast, nil
+	}
+	provider.GetChannelData(podcastId, podcastType == enum.PLAYLIST)
+	podcast := database.GetPodcast(podcastId)
+	if podcast == nil {
+		return models.Podcast{}, ErrPodcastNotFound
+	}
+	if podcast.Type == "" {
+		podcast.Type = string(podcastType)
+	}
+	refreshEpisodes(provider, podcast)
+	markPodcastRefreshed(podcast)
+	return *podcast, nil
+}
+
+func refreshEpisodes(provider MetadataProvider, podcast *models.Podcast) {
+	log.Info("[RSS FEED] Refreshing episodes for " + podcast.Id)
+	previousLatest, err := database.GetLatestEpisode(podcast.Id)
+	if err != nil {
+		log.Error(err)
+	}
+	previousVersion := database.GetEpisodesVersion(podcast.Id)
+
+	switch GetPodcastType(podcast) {
+	case enum.PLAYLIST:
+		provider.GetPlaylistEpisodes(podcast.Id)
+	case enum.CHANNEL:
+		provider.GetChannelEpisodes(podcast.Id)
+	case enum.CUSTOM:
+		// the sources are refreshed as podcasts of their own
+	}
+
+	predictSponsorTimeSkipped(podcast)
+	invalidateFeedCache(podcast.Id, database.GetEpisodesVersion(podcast.Id) != previousVersion)
+	prefetchNewEpisodes(podcast, previousLatest)
+}
+
+// Get the type of the podcast, podcasts saved before the type was stored are guessed from the id
+func GetPodcastType(podcast *models.Podcast) enum.PodcastType {
+	if podcast.Type != "" {
+		return enum.PodcastType(podcast.Type)
+	}
+	if strings.HasPrefix(podcast.Id, "UC") && len(podcast.Id) == 24 {
+		return enum.CHANNEL
+	}
+	return enum.PLAYLIST
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"os"
+
+	log "github.com/labstack/gommon/log"
+)
+
+// Queue the newest episodes of the podcast published after the previous latest episode,
+// up to the prefetch_latest feed setting. Episodes the filter rules of the feed reject are not downloaded.
+func prefetchNewEpisodes(podcast *models.Podcast, previousLatest *models.PodcastEpisode) {
+	if podcast.FeedSettings == nil || podcast.FeedSettings.PrefetchLatest <= 0 {
+		return
+	}
+
+	episodes, err := database.GetLatestPodcastEpisodes(podcast.Id, feedEpisodeBatchSize)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	prefetched := 0
+	for _, episode := range episodes {
+		if prefetched >= podcast.FeedSettings.PrefetchLatest {
+			break
+		}
+		if previousLatest != nil && previousLatest.PublishedDate != "" && episode.PublishedDate <= previousLatest.PublishedDate {
+			break
+		}
+		if isEpisodeFiltered(podcast.FeedSettings, GetPodcastType(podcast), episode) {
+			continue
+		}
+		prefetched++
+		format := getFeedMediaFormat(podcast.FeedSettings, enum.AUDIO)
+		if _, err := os.Stat(format.FilePath(episode.YoutubeVideoId)); err == nil {
+			continue
+		}
+		log.Debug("[PREFETCH] Queued episode " + episode.YoutubeVideoId)
+		queueDownload(episode.YoutubeVideoId, format, DOWNLOAD_PRIORITY_PREFETCH)
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+	"github.com/lrstanley/go-ytdlp"
+)
+
+const progressSubscriberBuffer = 50
+
+// DownloadProgress is a point in time snapshot of an episode being downloaded.
+// Phase is one of the enum.DownloadPhase values while running, or the final
+// enum.DownloadStatus of the job once the attempt is over.
+type DownloadProgress struct {
+	FileName        string  `json:"file_name"`
+	YoutubeVideoId  string  `json:"youtube_video_id"`
+	Phase           string  `json:"phase"`
+	Percent         float64 `json:"percent"`
+	EtaSeconds      int64   `json:"eta_seconds"`
+	DownloadedBytes int     `json:"downloaded_bytes"`
+	TotalBytes      int     `json:"total_bytes"`
+	UpdatedDate     int64   `json:"updated_date"`
+}
+
+var (
+	downloadProgress      = map[string]DownloadProgress{}
+	progressSubscribers   = map[chan DownloadProgress]struct{}{}
+	downloadProgressMutex sync.Mutex
+)
+
+// Get the progress of every download currently running
+func GetDownloadProgress() []DownloadProgress {
+	downloadProgressMutex.Lock()
+	defer downloadProgressMutex.Unlock()
+
+	progress := make([]DownloadProgress, 0, len(downloadProgress))
+	for _, p := range downloadProgress {
+		progress = append(progress, p)
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].FileName < progress[j].FileName
+	})
+	return progress
+}
+
+func GetFileDownloadProgress(fileName string) *DownloadProgress {
+	downloadProgressMutex.Lock()
+	defer downloadProgressMutex.Unlock()
+
+	if p, ok := downloadProgress[fileName]; ok {
+		return &p
+	}
+	return nil
+}
+
+// Subscribe to progress updates. Call the returned func to unsubscribe.
+func SubscribeDownloadProgress() (<-chan DownloadProgress, func()) {
+	updates := make(chan DownloadProgress, progressSubscriberBuffer)
+
+	downloadProgressMutex.Lock()
+	progressSubscribers[updates] = struct{}{}
+	downloadProgressMutex.Unlock()
+
+	return updates, func() {
+		downloadProgressMutex.Lock()
+		delete(progressSubscribers, updates)
+		downloadProgressMutex.Unlock()
+	}
+}
+
+func setDownloadProgress(progress DownloadProgress) {
+	progress.UpdatedDate = time.Now().Unix()
+
+	downloadProgressMutex.Lock()
+	defer downloadProgressMutex.Unlock()
+	downloadProgress[progress.FileName] = progress
+	publishDownloadProgress(progress)
+}
+
+func setDownloadPhase(youtubeVideoId string, format MediaFormat, phase enum.DownloadPhase) {
+	fileName := format.FileName(youtubeVideoId)
+	downloadProgressMutex.Lock()
+	progress := downloadProgress[fileName]
+	downloadProgressMutex.Unlock()
+
+	if progress.Phase == string(phase) {
+		return
+	}
+	progress.FileName = fileName
+	progress.YoutubeVideoId = youtubeVideoId
+	progress.Phase = string(phase)
+	progress.EtaSeconds = 0
+	setDownloadProgress(progress)
+}
+
+// Send the final status of the download attempt to subscribers and stop tracking it
+func finishDownloadProgress(job *models.DownloadJob, status enum.DownloadStatus) {
+	downloadProgressMutex.Lock()
+	defer downloadProgressMutex.Unlock()
+
+	progress := downloadProgress[job.FileName]
+	progress.FileName = job.FileName
+	progress.YoutubeVideoId = job.YoutubeVideoId
+	progress.Phase = string(status)
+	progress.EtaSeconds = 0
+	progress.UpdatedDate = time.Now().Unix()
+	if status == enum.DONE {
+		progress.Percent = 100
+	}
+	delete(downloadProgress, job.FileName)
+	publishDownloadProgress(progress)
+}
+
+// Must be called with downloadProgressMutex held. Slow subscribers miss updates instead of blocking downloads.
+func publishDownloadProgress(progress DownloadProgress) {
+	for subscriber := range progressSubscribers {
+		select {
+		case subscriber <- progress:
+		default:
+		}
+	}
+}
+
+// Build the yt-dlp progress callback for a video file. Once the download itself finishes the rest
+// of the run is post processing.
+func trackDownloadProgress(youtubeVideoId string, format MediaFormat) ytdlp.ProgressCallbackFunc {
+	return func(prog ytdlp.ProgressUpdate) {
+		log.Debugf("%s @ %s [eta: %s] :: %s", prog.Status, prog.PercentString(), prog.ETA(), prog.Filename)
+
+		phase := enum.DOWNLOADING
+		if prog.Status == ytdlp.ProgressStatusFinished || prog.Status == ytdlp.ProgressStatusPostProcessing {
+			phase = enum.POST_PROCESSING
+		}
+		setDownloadProgress(DownloadProgress{
+			FileName:        format.FileName(youtubeVideoId),
+			YoutubeVideoId:  youtubeVideoId,
+			Phase:           string(phase),
+			Percent:         prog.Percent(),
+			EtaSeconds:      int64(prog.ETA().Seconds()),
+			DownloadedBytes: prog.DownloadedBytes,
+			TotalBytes:      prog.TotalBytes,
+		})
+	}
+}
+
+// yt-dlp does not report post processor progress, but cutting the SponsorBlock segments writes a
+// <id>.temp file next to the download. Watch for it until stop is closed.
+func watchSponsorBlockPhase(youtubeVideoId string, format MediaFormat, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if matches, _ := filepath.Glob(filepath.Join(mediaDir, youtubeVideoId+".temp."+format.Extension)); len(matches) > 0 {
+				setDownloadPhase(youtubeVideoId, format, enum.SPONSORBLOCK)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	log "github.com/labstack/gommon/log"
+	"google.golang.org/api/googleapi"
+)
+
+const defaultQuotaReportDays = 7
+
+// YouTube Data API quota cost of each endpoint, see https://developers.google.com/youtube/v3/determine_quota_cost
+var quotaCosts = map[string]int{
+	"channels.list":      1,
+	"playlists.list":     1,
+	"playlistItems.list": 1,
+	"videos.list":        1,
+	"search.list":        100,
+}
+
+// the YouTube API quota resets at midnight Pacific time
+var quotaLocation = loadQuotaLocation()
+
+// quotaRun adds up the quota units spent while refreshing one podcast
+type quotaRun struct {
+	podcastId string
+	units     map[string]int
+}
+
+// QuotaReport is the YouTube API quota usage of the last days, per endpoint and per podcast
+type QuotaReport struct {
+	Date      string              `json:"date"`
+	Budget    int                 `json:"budget"`
+	UsedToday int                 `json:"used_today"`
+	ResetDate string              `json:"reset_date"`
+	Podcasts  []PodcastQuotaUsage `json:"podcasts"`
+	Usage     []models.QuotaUsage `json:"usage"`
+}
+
+// PodcastQuotaUsage is the quota a podcast used over the days of a report
+type PodcastQuotaUsage struct {
+	PodcastId string `json:"podcast_id"`
+	Units     int    `json:"units"`
+	Calls     int    `json:"calls"`
+}
+
+func loadQuotaLocation() *time.Location {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		log.Error(err)
+		return time.UTC
+	}
+	return location
+}
+
+func quotaDay(t time.Time) string {
+	return t.In(quotaLocation).Format(time.DateOnly)
+}
+
+func nextQuotaReset(now time.Time) time.Time {
+	t := now.In(quotaLocation)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, quotaLocation)
+}
+
+// Get the daily quota budget from YOUTUBE_QUOTA_BUDGET, 0 means there is no budget
+func getQuotaBudget() int {
+	return getEnvInt("YOUTUBE_QUOTA_BUDGET", 0)
+}
+
+func isQuotaBudgetReached() bool {
+	budget := getQuotaBudget()
+	return budget > 0 && database.GetQuotaUnitsUsed(quotaDay(time.Now())) >= budget
+}
+
+// Refreshes that can wait are deferred until the quota reset once the budget is reached or every API key
+// is out of quota, only the YouTube API provider uses quota
+func isQuotaDeferred(provider MetadataProvider) bool {
+	_, usesQuota := provider.(*youtubeApiProvider)
+	return usesQuota && (isQuotaBudgetReached() || !hasAvailableApiKey())
+}
+
+// Call the YouTube API and charge the quota of the endpoint to the refresh, failed calls use quota as well.
+// A key that is out of quota is parked and the call is retried with the next one.
+func callYoutube[T any](quota *quotaRun, endpoint string, do func(...googleapi.CallOption) (T, error)) (T, error) {
+	for {
+		key, ok := nextApiKey()
+		if !ok {
+			var empty T
+			return empty, errNoApiKey
+		}
+		result, err := do(googleapi.QueryParameter("key", key))
+		quota.add(endpoint)
+		if !isQuotaExceeded(err) {
+			return result, err
+		}
+		parkApiKey(key)
+	}
+}
+
+func newQuotaRun(podcastId string) *quotaRun {
+	return &quotaRun{podcastId: podcastId, units: map[string]int{}}
+}
+
+func (r *quotaRun) add(endpoint string) {
+	r.units[endpoint] += quotaCosts[endpoint]
+	database.AddQuotaUsage(quotaDay(time.Now()), endpoint, r.podcastId, quotaCosts[endpoint])
+}
+
+func (r *quotaRun) total() int {
+	total := 0
+	for _, units := range r.units {
+		total += units
+	}
+	return total
+}
+
+func (r *quotaRun) logUsage() {
+	if len(r.units) == 0 {
+		return
+	}
+	endpoints := make([]string, 0, len(r.units))
+	for endpoint, units := range r.units {
+		endpoints = append(endpoints, endpoint+": "+strconv.Itoa(units))
+	}
+	sort.Strings(endpoints)
+	log.Infof("[QUOTA] %s used %d units (%s)", r.podcastId, r.total(), strings.Join(endpoints, ", "))
+}
+
+// Build the quota report of the given number of days, today included
+func GetQuotaReport(days int) (*QuotaReport, error) {
+	if days <= 0 {
+		days = defaultQuotaReportDays
+	}
+	now := time.Now()
+	usage, err := database.GetQuotaUsage(quotaDay(now.AddDate(0, 0, 1-days)))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &QuotaReport{
+		Date:      quotaDay(now),
+		Budget:    getQuotaBudget(),
+		ResetDate: nextQuotaReset(now).Format(time.RFC3339),
+		Podcasts:  []PodcastQuotaUsage{},
+		Usage:     usage,
+	}
+	podcasts := map[string]*PodcastQuotaUsage{}
+	for _, u := range usage {
+		if u.Date == report.Date {
+			report.UsedToday += u.Units
+		}
+		podcast, ok := podcasts[u.PodcastId]
+		if !ok {
+			podcast = &PodcastQuotaUsage{PodcastId: u.PodcastId}
+			podcasts[u.PodcastId] = podcast
+		}
+		podcast.Units += u.Units
+		podcast.Calls += u.Calls
+	}
+	for _, podcast := range podcasts {
+		report.Podcasts = append(report.Podcasts, *podcast)
+	}
+	sort.Slice(report.Podcasts, func(i, j int) bool {
+		return report.Podcasts[i].Units > report.Podcasts[j].Units
+	})
+	return report, nil
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+)
+
+const (
+	defaultRefreshInterval = 60 * time.Minute
+	defaultRefreshJitter   = 5 * time.Minute
+)
+
+var refresherMutex sync.Mutex
+
+// Refresh every podcast whose next refresh date has passed. Runs on a schedule from the app cron.
+func RefreshDuePodcasts() {
+	if !refresherMutex.TryLock() {
+		log.Debug("[REFRESHER] Previous refresh still running, skipping...")
+		return
+	}
+	defer refresherMutex.Unlock()
+
+	podcasts, err := database.GetPodcastsDueForRefresh(time.Now().Unix())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(podcasts) == 0 {
+		return
+	}
+
+	log.Infof("[REFRESHER] Refreshing %d podcasts...", len(podcasts))
+	provider := getMetadataProvider()
+	for i := range podcasts {
+		podcast := &podcasts[i]
+		interval := getRefreshInterval(podcast.FeedSettings)
+		if interval == 0 {
+			// refreshed when the feed is requested instead, check back in later
+			database.UpdatePodcastRefreshDates(podcast.Id, podcast.LastRefreshDate, time.Now().Add(defaultRefreshInterval).Unix())
+			continue
+		}
+		if isQuotaDeferred(provider) {
+			log.Info("[QUOTA] Daily budget reached, refreshing " + podcast.Id + " after the quota reset")
+			database.UpdatePodcastRefreshDates(podcast.Id, podcast.LastRefreshDate, addRefreshJitter(nextQuotaReset(time.Now())).Unix())
+			continue
+		}
+		refreshEpisodes(provider, podcast)
+		markPodcastRefreshed(podcast)
+	}
+}
+
+// Record the refresh and schedule the next one with some jitter so feeds do not all refresh at once
+func markPodcastRefreshed(podcast *models.Podcast) {
+	interval := getRefreshInterval(podcast.FeedSettings)
+	if interval == 0 {
+		interval = defaultRefreshInterval
+	}
+	next := addRefreshJitter(time.Now().Add(interval))
+	database.UpdatePodcastRefreshDates(podcast.Id, time.Now().Unix(), next.Unix())
+}
+
+func addRefreshJitter(t time.Time) time.Time {
+	if jitter := getRefreshJitter(); jitter > 0 {
+		return t.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return t
+}
+
+// Feeds are served straight from the database once the background refresher has picked them up
+func shouldRefreshOnRequest(podcast *models.Podcast) bool {
+	if podcast == nil || podcast.LastRefreshDate == 0 {
+		return true
+	}
+	return getRefreshInterval(podcast.FeedSettings) == 0
+}
+
+// Get the refresh interval for a feed, 0 means the feed is only refreshed when requested
+func getRefreshInterval(settings *models.FeedSettings) time.Duration {
+	if settings != nil && settings.RefreshIntervalMinutes != nil {
+		if *settings.RefreshIntervalMinutes <= 0 {
+			return 0
+		}
+		return time.Duration(*settings.RefreshIntervalMinutes) * time.Minute
+	}
+	return getEnvMinutes("REFRESH_INTERVAL", defaultRefreshInterval)
+}
+
+func getRefreshJitter() time.Duration {
+	return getEnvMinutes("REFRESH_JITTER", defaultRefreshJitter)
+}
+
+func getEnvMinutes(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes < 0 {
+		log.Errorf("Invalid %s %q, using default", key, value)
+		return defaultValue
+	}
+	return time.Duration(minutes) * time.Minute
+}
@@ -1,10 +1,14 @@
 package services
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
+	"ikoyhn/podcast-sponsorblock/internal/database"
 	"ikoyhn/podcast-sponsorblock/internal/enum"
 	"ikoyhn/podcast-sponsorblock/internal/models"
+	"math"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -14,36 +18,72 @@ import (
 	log "github.com/labstack/gommon/log"
 )
 
-func GenerateRssFeed(podcast models.Podcast, host string, podcastType enum.PodcastType) []byte {
+// Feed is a rendered feed with the validators used for conditional requests
+type Feed struct {
+	Data         []byte
+	ETag         string
+	LastModified time.Time
+}
+
+func GenerateRssFeed(podcast models.Podcast, host string, podcastType enum.PodcastType, options FeedOptions, hasNextPage bool) *Feed {
 	log.Info("[RSS FEED] Generating RSS Feed...")
 
 	podcastLink := "https://www.youtube.com/playlist?list=" + podcast.Id
 
 	if podcastType == enum.CHANNEL {
 		podcastLink = "https://www.youtube.com/channel/" + podcast.Id
+	} else if podcastType == enum.CUSTOM && options.MediaType == enum.VIDEO {
+		podcastLink = host + "/video/feed/" + podcast.Id
+	} else if podcastType == enum.CUSTOM {
+		podcastLink = host + "/feed/" + podcast.Id
 	}
 
-	now := time.Now()
-	ytPodcast := New(podcast.PodcastName, podcastLink, podcast.Description, &now)
+	settings := database.GetFeedSettings(podcast.Id)
+	lastModified := getFeedLastModified(podcast, settings)
+	ytPodcast := New(podcast.PodcastName, podcastLink, podcast.Description, &lastModified)
 	ytPodcast.AddImage(transformArtworkURL(podcast.ImageUrl, 1000, 1000))
 	ytPodcast.AddCategory(podcast.Category, []string{""})
 	ytPodcast.Docs = "http://www.rssboard.org/rss-specification"
 	ytPodcast.IAuthor = podcast.ArtistName
+	ytPodcast.AtomLinks = getPageLinks(host, options, hasNextPage)
+
+	videoIds := make([]string, 0, len(podcast.PodcastEpisodes))
+	for _, podcastEpisode := range podcast.PodcastEpisodes {
+		videoIds = append(videoIds, podcastEpisode.YoutubeVideoId)
+	}
+	// the media files are shared between feeds, so the segments are cut or marked as set by the podcast they belong to
+	mediaSettings := getMediaFeedSettings(videoIds)
+	feedFormat := getFeedMediaFormat(settings, options.MediaType)
+	histories := database.GetEpisodePlaybackHistories(videoIds)
+	withChapters := database.GetVideoIdsWithChapters(videoIds)
+	withTranscripts := getTranscriptVideoIds()
 
 	if podcast.PodcastEpisodes != nil {
 		for _, podcastEpisode := range podcast.PodcastEpisodes {
-			if (podcastEpisode.Type == "CHANNEL" && podcastEpisode.Duration.Seconds() < 120) || podcastEpisode.EpisodeName == "Private video" || podcastEpisode.EpisodeDescription == "This video is private." {
-				continue
+			marksSegments := getSponsorBlockMode(mediaSettings[podcastEpisode.YoutubeVideoId]) == enum.MARK
+			cutsSegments := !marksSegments
+			format := feedFormat
+			if podcastType == enum.CUSTOM {
+				// custom feeds have no audio settings of their own and link the files of their sources
+				format = getFeedMediaFormat(mediaSettings[podcastEpisode.YoutubeVideoId], options.MediaType)
 			}
-			mediaUrl := host + "/media/" + podcastEpisode.YoutubeVideoId + ".m4a"
+			mediaUrl := host + "/media/" + format.FileName(podcastEpisode.YoutubeVideoId)
+			chaptersUrl := host + "/chapters/" + podcastEpisode.YoutubeVideoId + ".json"
+			transcriptUrl := host + "/transcripts/" + podcastEpisode.YoutubeVideoId + "."
+			tokenQuery := ""
 
 			if os.Getenv("TOKEN") != "" {
-				mediaUrl = mediaUrl + "?token=" + os.Getenv("TOKEN")
+				tokenQuery = "?token=" + os.Getenv("TOKEN")
+				mediaUrl = mediaUrl + tokenQuery
+				chaptersUrl = chaptersUrl + tokenQuery
 			}
 			enclosure := Enclosure{
 				URL:    mediaUrl,
 				Length: 0,
-				Type:   M4A,
+				Type:   format.EnclosureType,
+			}
+			if info, err := os.Stat(format.FilePath(podcastEpisode.YoutubeVideoId)); err == nil {
+				enclosure.Length = info.Size()
 			}
 
 			var builder strings.Builder
@@ -51,9 +91,12 @@ func GenerateRssFeed(podcast models.Podcast, host string, podcastType enum.Podca
 			escapedDescription := builder.String()
 
 			parseTime := parseTimeFromString(podcastEpisode.PublishedDate)
+			numbering := getEpisodeNumbering(podcastEpisode.EpisodeName)
+			durationSeconds := getEpisodeDurationSeconds(podcastEpisode, histories, cutsSegments)
 
 			podcastItem := Item{
 				Title:       podcastEpisode.EpisodeName,
+				Link:        youtubeVideoUrl + podcastEpisode.YoutubeVideoId,
 				Description: escapedDescription,
 				GUID: struct {
 					Value       string `xml:",chardata"`
@@ -62,14 +105,73 @@ func GenerateRssFeed(podcast models.Podcast, host string, podcastType enum.Podca
 					Value:       podcastEpisode.YoutubeVideoId,
 					IsPermaLink: false,
 				},
-				Enclosure: &enclosure,
-				PubDate:   &parseTime,
+				Enclosure:       &enclosure,
+				PubDate:         &parseTime,
+				IDuration:       formatItunesDuration(durationSeconds),
+				DurationSeconds: durationSeconds,
+				IImage:          &IImage{HREF: getEpisodeImageUrl(podcastEpisode.YoutubeVideoId)},
+				ContentEncoded: &ContentEncoded{
+					Text: buildShowNotes(podcastEpisode.YoutubeVideoId, podcastEpisode.EpisodeDescription),
+				},
+				IEpisodeType: numbering.EpisodeType,
+				ISeason:      numbering.Season,
+				IEpisode:     numbering.Episode,
+			}
+			if withChapters[podcastEpisode.YoutubeVideoId] || (marksSegments && hasSponsorSegments(podcastEpisode, histories)) {
+				podcastItem.Chapters = &Chapters{
+					URL:  chaptersUrl,
+					Type: CHAPTERS_MIME_TYPE,
+				}
+			}
+			// subtitles are downloaded along with the episode, videos without them are not linked
+			if withTranscripts[podcastEpisode.YoutubeVideoId] {
+				podcastItem.Transcripts = []Transcript{
+					{URL: transcriptUrl + TRANSCRIPT_VTT + tokenQuery, Type: transcriptMimeTypes[TRANSCRIPT_VTT], Rel: "captions"},
+					{URL: transcriptUrl + TRANSCRIPT_SRT + tokenQuery, Type: transcriptMimeTypes[TRANSCRIPT_SRT], Rel: "captions"},
+				}
 			}
+			podcastItem.AddSummary(podcastEpisode.EpisodeDescription)
 			ytPodcast.AddItem(podcastItem)
 		}
 	}
 
-	return ytPodcast.Bytes()
+	data := encodeFeed(&ytPodcast, options.Format)
+	hash := sha256.Sum256(data)
+	return &Feed{
+		Data:         data,
+		ETag:         `"` + hex.EncodeToString(hash[:16]) + `"`,
+		LastModified: lastModified,
+	}
+}
+
+// Get when the episodes, podcast details or settings of the feed last changed, falling back to the last refresh
+// for feeds without episodes
+func getFeedLastModified(podcast models.Podcast, settings *models.FeedSettings) time.Time {
+	var lastModified time.Time
+	if podcast.UpdatedDate > 0 {
+		lastModified = time.Unix(podcast.UpdatedDate, 0)
+	}
+	if settings != nil && settings.UpdatedDate > 0 && time.Unix(settings.UpdatedDate, 0).After(lastModified) {
+		lastModified = time.Unix(settings.UpdatedDate, 0)
+	}
+	if podcast.ContentUpdatedDate > 0 && time.Unix(podcast.ContentUpdatedDate, 0).After(lastModified) {
+		lastModified = time.Unix(podcast.ContentUpdatedDate, 0)
+	}
+	for _, episode := range podcast.PodcastEpisodes {
+		if published, err := time.Parse(time.RFC3339, episode.PublishedDate); err == nil && published.After(lastModified) {
+			lastModified = published
+		}
+		if updated := time.Unix(episode.UpdatedDate, 0); episode.UpdatedDate > 0 && updated.After(lastModified) {
+			lastModified = updated
+		}
+	}
+	if lastModified.IsZero() && podcast.LastRefreshDate > 0 {
+		lastModified = time.Unix(podcast.LastRefreshDate, 0)
+	}
+	if lastModified.IsZero() {
+		lastModified = time.Now()
+	}
+	return lastModified.UTC().Truncate(time.Second)
 }
 
 func parseTimeFromString(date string) time.Time {
@@ -111,3 +213,39 @@ func transformArtworkURL(artworkURL string, newHeight int, newWidth int) string
 
 	return newURL.String()
 }
+
+// Get the duration of the episode in seconds after the SponsorBlock cut, 0 when unknown. The time skipped
+// when the episode was downloaded wins over the predicted one.
+func getEpisodeDurationSeconds(episode models.PodcastEpisode, histories map[string]models.EpisodePlaybackHistory, cutsSegments bool) int64 {
+	if episode.Duration <= 0 {
+		return 0
+	}
+	seconds := episode.Duration.Seconds()
+	if cutsSegments {
+		if history, ok := histories[episode.YoutubeVideoId]; ok && history.TotalTimeSkipped > 0 {
+			seconds -= history.TotalTimeSkipped
+		} else if episode.PredictedTimeSkipped != nil {
+			seconds -= *episode.PredictedTimeSkipped
+		}
+	}
+	if seconds < 1 {
+		seconds = 1
+	}
+	return int64(math.Round(seconds))
+}
+
+// Check whether SponsorBlock has segments for the episode, in mark mode they become chapters of their own
+func hasSponsorSegments(episode models.PodcastEpisode, histories map[string]models.EpisodePlaybackHistory) bool {
+	if history, ok := histories[episode.YoutubeVideoId]; ok && history.TotalTimeSkipped > 0 {
+		return true
+	}
+	return episode.PredictedTimeSkipped != nil && *episode.PredictedTimeSkipped > 0
+}
+
+// Format a duration as HH:MM:SS for itunes:duration
+func formatItunesDuration(seconds int64) string {
+	if seconds <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
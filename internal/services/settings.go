@@ -0,0 +1,181 @@
+package services
+
+import (
+	"ikoyhn/podcast-sponsorblock/internal/common"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+)
+
+const defaultChannelMinDuration = 120 * time.Second
+
+// yt-dlp audio quality, either a VBR level from 0 (best) to 10 or a bitrate such as 128K
+var audioBitratePattern = regexp.MustCompile(`^(10|[0-9]|[1-9][0-9]*[kK])$`)
+
+// Save the feed settings of a podcast. Files are cached by video id and format, so the downloaded episodes
+// are removed when the settings they were downloaded with change and downloaded again on the next request.
+func SaveFeedSettings(settings *models.FeedSettings) {
+	previous := database.GetFeedSettings(settings.PodcastId)
+	database.SaveFeedSettings(settings)
+	if getAudioFormat(previous) != getAudioFormat(settings) || getAudioBitrate(previous) != getAudioBitrate(settings) ||
+		getSponsorBlockMode(previous) != getSponsorBlockMode(settings) {
+		removePodcastMediaFiles(settings.PodcastId)
+	}
+}
+
+// Get the feed settings the media files of each video are made with, the same ones GetFeedSettingsByVideoId returns
+func getMediaFeedSettings(youtubeVideoIds []string) map[string]*models.FeedSettings {
+	podcastIds := database.GetMediaPodcastIds(youtubeVideoIds)
+	owners := make([]string, 0, len(podcastIds))
+	for _, podcastId := range podcastIds {
+		owners = append(owners, podcastId)
+	}
+	settingsByPodcast := database.GetFeedSettingsByPodcastIds(owners)
+
+	settingsByVideo := make(map[string]*models.FeedSettings, len(podcastIds))
+	for videoId, podcastId := range podcastIds {
+		settingsByVideo[videoId] = settingsByPodcast[podcastId]
+	}
+	return settingsByVideo
+}
+
+// Get the SponsorBlock categories to remove, the feed override wins over SPONSORBLOCK_CATEGORIES
+func getSponsorBlockCategories(settings *models.FeedSettings) []string {
+	categories := os.Getenv("SPONSORBLOCK_CATEGORIES")
+	if settings != nil && strings.TrimSpace(settings.SponsorBlockCategories) != "" {
+		categories = settings.SponsorBlockCategories
+	}
+	categoryList := splitSetting(categories)
+	if len(categoryList) == 0 {
+		return []string{"sponsor"}
+	}
+	return categoryList
+}
+
+// Get whether SponsorBlock segments are cut out or only marked as chapters, the feed override wins over SPONSORBLOCK_MODE
+func getSponsorBlockMode(settings *models.FeedSettings) enum.SponsorBlockMode {
+	value := os.Getenv("SPONSORBLOCK_MODE")
+	if settings != nil && strings.TrimSpace(settings.SponsorBlockMode) != "" {
+		value = settings.SponsorBlockMode
+	}
+	switch mode := enum.SponsorBlockMode(strings.ToUpper(strings.TrimSpace(value))); mode {
+	case enum.REMOVE, enum.MARK:
+		return mode
+	case "":
+		return enum.REMOVE
+	default:
+		log.Errorf("Unknown SponsorBlock mode %q, removing segments", value)
+		return enum.REMOVE
+	}
+}
+
+// Get the minimum episode duration, channels skip anything under two minutes by default
+func getMinDuration(settings *models.FeedSettings, podcastType enum.PodcastType) time.Duration {
+	if settings != nil && settings.MinDurationSeconds != nil {
+		return time.Duration(*settings.MinDurationSeconds) * time.Second
+	}
+	if podcastType == enum.CHANNEL || podcastType == enum.CUSTOM {
+		return defaultChannelMinDuration
+	}
+	return 0
+}
+
+// Get whether Shorts are left out of the feed, channels leave them out by default
+func getExcludeShorts(settings *models.FeedSettings, podcastType enum.PodcastType) bool {
+	if settings != nil && settings.ExcludeShorts != nil {
+		return *settings.ExcludeShorts
+	}
+	return podcastType == enum.CHANNEL || podcastType == enum.CUSTOM
+}
+
+// Get the cookies file in the config folder, the feed override wins over COOKIES_FILE.
+// yt-dlp writes the cookie jar back to the file, so a feed override has to be a plain file name.
+func getCookiesFile(settings *models.FeedSettings) string {
+	if settings != nil && strings.TrimSpace(settings.CookiesFile) != "" {
+		cookiesFile := strings.TrimSpace(settings.CookiesFile)
+		if !common.IsPlainFilename(cookiesFile) {
+			log.Errorf("Ignoring invalid cookies file %q of %s", cookiesFile, settings.PodcastId)
+			return ""
+		}
+		return cookiesFile
+	}
+	return strings.TrimSpace(os.Getenv("COOKIES_FILE"))
+}
+
+// Get the audio format of the feed, the feed override wins over AUDIO_FORMAT
+func getAudioFormat(settings *models.FeedSettings) MediaFormat {
+	value := os.Getenv("AUDIO_FORMAT")
+	if settings != nil && strings.TrimSpace(settings.AudioFormat) != "" {
+		value = settings.AudioFormat
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return AUDIO_M4A
+	}
+	format, ok := GetMediaFormat(value)
+	if !ok || format.MediaType != enum.AUDIO {
+		log.Errorf("Unknown audio format %q, using m4a", value)
+		return AUDIO_M4A
+	}
+	return format
+}
+
+// Get the target audio bitrate, the feed override wins over AUDIO_BITRATE. Empty keeps the source quality.
+func getAudioBitrate(settings *models.FeedSettings) string {
+	value := os.Getenv("AUDIO_BITRATE")
+	if settings != nil && strings.TrimSpace(settings.AudioBitrate) != "" {
+		value = settings.AudioBitrate
+	}
+	value = strings.TrimSpace(value)
+	if value != "" && !audioBitratePattern.MatchString(value) {
+		log.Errorf("Invalid audio bitrate %q, keeping the source quality", value)
+		return ""
+	}
+	return value
+}
+
+// Check the episode title against the comma separated include and exclude filters of the feed
+func isTitleFiltered(settings *models.FeedSettings, title string) bool {
+	if settings == nil {
+		return false
+	}
+	lowerTitle := strings.ToLower(title)
+
+	include := splitSetting(settings.TitleIncludeFilter)
+	if len(include) > 0 {
+		found := false
+		for _, term := range include {
+			if strings.Contains(lowerTitle, strings.ToLower(term)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true
+		}
+	}
+
+	for _, term := range splitSetting(settings.TitleExcludeFilter) {
+		if strings.Contains(lowerTitle, strings.ToLower(term)) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitSetting(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
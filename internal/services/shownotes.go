@@ -0,0 +1,83 @@
+package services
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const youtubeThumbnailUrl = "https://i.ytimg.com/vi/"
+
+var (
+	showNotesPattern     = regexp.MustCompile(`https?://[^\s<>"']+|\b(?:\d{1,2}:)?\d{1,2}:\d{2}\b`)
+	seasonPattern        = regexp.MustCompile(`(?i)\b(?:season\s*|s)(\d{1,3})(?:\s*[,:-]?\s*(?:episode\s*|ep\.?\s*|e)(\d{1,4}))?\b`)
+	episodeNumberPattern = regexp.MustCompile(`(?i)(?:\bepisode\s*|\bep\.?\s*|#)(\d{1,4})\b`)
+	trailerPattern       = regexp.MustCompile(`(?i)\b(?:trailer|teaser)\b`)
+	bonusPattern         = regexp.MustCompile(`(?i)\bbonus\b`)
+)
+
+// EpisodeNumbering is the iTunes episode type, season and episode number read from a title
+type EpisodeNumbering struct {
+	EpisodeType string
+	Season      string
+	Episode     string
+}
+
+func getEpisodeImageUrl(youtubeVideoId string) string {
+	return youtubeThumbnailUrl + youtubeVideoId + "/hqdefault.jpg"
+}
+
+// Turn the plain text video description into HTML show notes, linking urls and timestamps.
+// Timestamps link to that point of the YouTube video.
+func buildShowNotes(youtubeVideoId string, description string) string {
+	var builder strings.Builder
+	last := 0
+	for _, match := range showNotesPattern.FindAllStringIndex(description, -1) {
+		builder.WriteString(html.EscapeString(description[last:match[0]]))
+		text := description[match[0]:match[1]]
+		if strings.HasPrefix(text, "http") {
+			// trailing punctuation usually ends the sentence rather than the url
+			trimmed := strings.TrimRight(text, ".,;:!?)")
+			builder.WriteString(`<a href="` + html.EscapeString(trimmed) + `">` + html.EscapeString(trimmed) + `</a>`)
+			builder.WriteString(html.EscapeString(text[len(trimmed):]))
+		} else {
+			seconds := parseShowNotesTimestamp(text)
+			builder.WriteString(`<a href="` + youtubeVideoUrl + youtubeVideoId + "&amp;t=" + strconv.Itoa(seconds) + `s">` + text + `</a>`)
+		}
+		last = match[1]
+	}
+	builder.WriteString(html.EscapeString(description[last:]))
+	return strings.ReplaceAll(builder.String(), "\n", "<br>\n")
+}
+
+func parseShowNotesTimestamp(timestamp string) int {
+	seconds := 0
+	for _, part := range strings.Split(timestamp, ":") {
+		n, _ := strconv.Atoi(part)
+		seconds = seconds*60 + n
+	}
+	return seconds
+}
+
+// Read the episode type, season and episode number from patterns like "S2E5", "Season 2 Episode 5",
+// "Ep. 12", "#12", "Trailer" or "Bonus" in the title
+func getEpisodeNumbering(title string) EpisodeNumbering {
+	numbering := EpisodeNumbering{EpisodeType: "full"}
+	if trailerPattern.MatchString(title) {
+		numbering.EpisodeType = "trailer"
+	} else if bonusPattern.MatchString(title) {
+		numbering.EpisodeType = "bonus"
+	}
+
+	if match := seasonPattern.FindStringSubmatch(title); match != nil {
+		numbering.Season = strings.TrimLeft(match[1], "0")
+		numbering.Episode = strings.TrimLeft(match[2], "0")
+	}
+	if numbering.Episode == "" {
+		if match := episodeNumberPattern.FindStringSubmatch(title); match != nil {
+			numbering.Episode = strings.TrimLeft(match[1], "0")
+		}
+	}
+	return numbering
+}
@@ -2,52 +2,93 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/models"
 	"io"
 	"net/http"
-	"os"
-	"strings"
+	"sort"
 
 	log "github.com/labstack/gommon/log"
 )
 
-const SPONSORBLOCK_API_URL = "https://sponsor.ajay.app/api/skipSegments?videoID="
+const (
+	SPONSORBLOCK_API_URL = "https://sponsor.ajay.app/api/skipSegments?videoID="
+
+	predictedSkipBatchSize = 25
+)
 
 func TotalSponsorTimeSkipped(youtubeVideoId string) float64 {
+	sponsorBlockResponse, err := getSponsorBlockSegments(youtubeVideoId)
+	if err != nil {
+		log.Error(err)
+	}
+	totalTimeSkipped := calculateSkippedTime(sponsorBlockResponse)
+
+	return totalTimeSkipped
+}
+
+// Get the segments of the video in the categories removed for its feed, ordered by start time
+func getSponsorBlockSegments(youtubeVideoId string) ([]SponsorBlockResponse, error) {
 	log.Debug("[SponsorBlock] Looking up podcast in SponsorBlock API...")
 	endURL := SPONSORBLOCK_API_URL + youtubeVideoId
-	
-	if categories := getCategories(); categories != nil {
-		for _, category := range categories {
-			endURL += "&category=" + strings.TrimSpace(category)
-		}
+
+	settings := database.GetFeedSettingsByVideoId(youtubeVideoId)
+	for _, category := range getSponsorBlockCategories(settings) {
+		endURL += "&category=" + category
 	}
 
 	resp, err := http.Get(endURL)
 	if err != nil {
-		log.Error(err)
-		return 0
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		log.Errorf("Video not found on SponsorBlock API: %s", youtubeVideoId)
-		return 0
+		log.Debugf("Video not found on SponsorBlock API: %s", youtubeVideoId)
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SponsorBlock API returned status code %d for %s", resp.StatusCode, youtubeVideoId)
 	}
 
 	body, bodyErr := io.ReadAll(resp.Body)
 	if bodyErr != nil {
-		log.Error(bodyErr)
-		return 0
+		return nil, bodyErr
 	}
 	sponsorBlockResponse, marshErr := unmarshalSponsorBlockResponse(body)
 	if marshErr != nil {
-		log.Error(marshErr)
-		return 0
+		return nil, marshErr
 	}
 
-	totalTimeSkipped := calculateSkippedTime(sponsorBlockResponse)
+	segments := make([]SponsorBlockResponse, 0, len(sponsorBlockResponse))
+	for _, segment := range sponsorBlockResponse {
+		if len(segment.Segment) == 2 {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Segment[0] < segments[j].Segment[0]
+	})
+	return segments, nil
+}
 
-	return totalTimeSkipped
+// Look up how much SponsorBlock will cut from the newest episodes that have not been checked yet,
+// so feeds can report the duration before an episode is downloaded
+func predictSponsorTimeSkipped(podcast *models.Podcast) {
+	episodes, err := database.GetEpisodesWithoutPredictedSkip(podcast.Id, predictedSkipBatchSize)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, episode := range episodes {
+		segments, err := getSponsorBlockSegments(episode.YoutubeVideoId)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		database.UpdateEpisodePredictedSkip(episode.YoutubeVideoId, calculateSkippedTime(segments))
+	}
 }
 
 func unmarshalSponsorBlockResponse(data []byte) ([]SponsorBlockResponse, error) {
@@ -80,14 +121,6 @@ func calculateSkippedTime(segments []SponsorBlockResponse) float64 {
 	return skippedTime
 }
 
-func getCategories() []string {
-	categories := os.Getenv("SPONSORBLOCK_CATEGORIES")
-	if categories == "" {
-		return nil
-	}
-	return strings.Split(categories, ",")
-}
-
 type SponsorBlockResponse struct {
 	Segment       []float64 `json:"segment"`
 	UUID          string    `json:"UUID"`
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+	"github.com/lrstanley/go-ytdlp"
+)
+
+const (
+	transcriptDir          = "/config/transcripts"
+	defaultTranscriptLangs = "en"
+
+	TRANSCRIPT_VTT = "vtt"
+	TRANSCRIPT_SRT = "srt"
+
+	// subtitles are sometimes added after upload, so videos without them are checked again once a day
+	transcriptMissingDuration = 24 * time.Hour
+)
+
+var (
+	transcriptMimeTypes = map[string]string{
+		TRANSCRIPT_VTT: "text/vtt",
+		TRANSCRIPT_SRT: "application/x-subrip",
+	}
+	transcriptMutexes sync.Map
+	errNoSubtitles    = errors.New("no subtitles found")
+	vttTagPattern     = regexp.MustCompile(`<[^>]*>`)
+	vttBlockPattern   = regexp.MustCompile(`\r?\n\r?\n+`)
+)
+
+type transcriptCue struct {
+	start    float64
+	end      float64
+	settings string
+	text     []string
+}
+
+func GetTranscriptMimeType(format string) (string, bool) {
+	mimeType, ok := transcriptMimeTypes[format]
+	return mimeType, ok
+}
+
+// Get the transcript of an episode in the given format with the cue timestamps remapped around
+// the removed SponsorBlock segments. Subtitles are downloaded on first use. Returns the language as well.
+func GetEpisodeTranscript(youtubeVideoId string, format string) ([]byte, string, error) {
+	path, err := getTranscriptFile(youtubeVideoId)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cues := parseVtt(string(data))
+	if getSponsorBlockMode(database.GetFeedSettingsByVideoId(youtubeVideoId)) == enum.REMOVE {
+		removed, err := getRemovedSegments(youtubeVideoId)
+		if err != nil {
+			return nil, "", err
+		}
+		cues = shiftCues(cues, removed)
+	}
+
+	language := transcriptLanguage(youtubeVideoId, path)
+	if format == TRANSCRIPT_SRT {
+		return []byte(formatSrt(cues)), language, nil
+	}
+	return []byte(formatVtt(cues)), language, nil
+}
+
+func getTranscriptFile(youtubeVideoId string) (string, error) {
+	mutex, _ := transcriptMutexes.LoadOrStore(youtubeVideoId, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer transcriptMutexes.Delete(youtubeVideoId)
+	defer mutex.(*sync.Mutex).Unlock()
+
+	if path := findTranscriptFile(youtubeVideoId); path != "" {
+		return path, nil
+	}
+	if isTranscriptMissing(youtubeVideoId) {
+		return "", errNoSubtitles
+	}
+	if err := downloadTranscript(youtubeVideoId); err != nil {
+		markTranscriptMissing(youtubeVideoId)
+		return "", err
+	}
+	if path := findTranscriptFile(youtubeVideoId); path != "" {
+		return path, nil
+	}
+	markTranscriptMissing(youtubeVideoId)
+	return "", errNoSubtitles
+}
+
+// Failed lookups leave an empty <id>.missing file, its modification time is when the video was last checked
+func isTranscriptMissing(youtubeVideoId string) bool {
+	info, err := os.Stat(filepath.Join(transcriptDir, youtubeVideoId+".missing"))
+	return err == nil && time.Since(info.ModTime()) < transcriptMissingDuration
+}
+
+func markTranscriptMissing(youtubeVideoId string) {
+	if err := os.MkdirAll(transcriptDir, 0755); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(transcriptDir, youtubeVideoId+".missing"), nil, 0644); err != nil {
+		log.Error(err)
+	}
+}
+
+// Subtitles are saved as <id>.<language>.vtt, prefer the languages in the order of TRANSCRIPT_LANGS
+func findTranscriptFile(youtubeVideoId string) string {
+	matches, _ := filepath.Glob(filepath.Join(transcriptDir, youtubeVideoId+".*.vtt"))
+	if len(matches) == 0 {
+		return ""
+	}
+	for _, lang := range getTranscriptLangs() {
+		for _, match := range matches {
+			if transcriptLanguage(youtubeVideoId, match) == lang {
+				return match
+			}
+		}
+	}
+	return matches[0]
+}
+
+// Get the ids of the videos with downloaded subtitles, read from the transcript folder in one pass
+func getTranscriptVideoIds() map[string]bool {
+	videoIds := make(map[string]bool)
+	entries, err := os.ReadDir(transcriptDir)
+	if err != nil {
+		return videoIds
+	}
+	for _, entry := range entries {
+		if videoId, _, found := strings.Cut(entry.Name(), "."); found && strings.HasSuffix(entry.Name(), ".vtt") {
+			videoIds[videoId] = true
+		}
+	}
+	return videoIds
+}
+
+func transcriptLanguage(youtubeVideoId string, path string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), youtubeVideoId+"."), ".vtt")
+}
+
+func getTranscriptLangs() []string {
+	langs := splitSetting(os.Getenv("TRANSCRIPT_LANGS"))
+	if len(langs) == 0 {
+		return []string{defaultTranscriptLangs}
+	}
+	return langs
+}
+
+// Download the manual subtitles of the video, falling back to the automatic captions
+func downloadTranscript(youtubeVideoId string) error {
+	log.Debug("[TRANSCRIPT] Downloading subtitles for " + youtubeVideoId)
+	dl := ytdlp.New().
+		SkipDownload().
+		NoPlaylist().
+		WriteSubs().
+		WriteAutoSubs().
+		SubLangs(strings.Join(getTranscriptLangs(), ",")).
+		SubFormat("vtt").
+		Paths(transcriptDir).
+		Output(youtubeVideoId + ".%(ext)s")
+
+	cookiesFile := getCookiesFile(database.GetFeedSettingsByVideoId(youtubeVideoId))
+	if cookiesFile != "" {
+		dl.Cookies("/config/" + cookiesFile)
+	}
+
+	r, err := dl.Run(context.TODO(), youtubeVideoUrl+youtubeVideoId)
+	if r != nil && r.ExitCode != 0 {
+		return fmt.Errorf("yt-dlp exited with code %d: %s", r.ExitCode, stderrTail(r.Stderr))
+	}
+	return err
+}
+
+func parseVtt(data string) []transcriptCue {
+	cues := []transcriptCue{}
+	blocks := vttBlockPattern.Split(strings.TrimSpace(data), -1)
+	for _, block := range blocks {
+		lines := strings.Split(strings.ReplaceAll(block, "\r\n", "\n"), "\n")
+		for i, line := range lines {
+			if !strings.Contains(line, "-->") {
+				continue
+			}
+			parts := strings.Fields(line)
+			if len(parts) < 3 {
+				break
+			}
+			start, startErr := parseCueTime(parts[0])
+			end, endErr := parseCueTime(parts[2])
+			if startErr != nil || endErr != nil {
+				break
+			}
+			cues = append(cues, transcriptCue{
+				start:    start,
+				end:      end,
+				settings: strings.Join(parts[3:], " "),
+				text:     lines[i+1:],
+			})
+			break
+		}
+	}
+	return cues
+}
+
+// Parse a hh:mm:ss.mmm or mm:ss.mmm timestamp, SRT style commas are accepted as well
+func parseCueTime(value string) (float64, error) {
+	parts := strings.Split(strings.ReplaceAll(value, ",", "."), ":")
+	seconds := float64(0)
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// Remap the cues around the removed ranges, cues inside a removed range are dropped
+func shiftCues(cues []transcriptCue, removed [][2]float64) []transcriptCue {
+	if len(removed) == 0 {
+		return cues
+	}
+	shifted := make([]transcriptCue, 0, len(cues))
+	for _, cue := range cues {
+		cue.start = shiftTimestamp(cue.start, removed)
+		cue.end = shiftTimestamp(cue.end, removed)
+		if cue.end <= cue.start {
+			continue
+		}
+		shifted = append(shifted, cue)
+	}
+	return shifted
+}
+
+func formatVtt(cues []transcriptCue) string {
+	var builder strings.Builder
+	builder.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		builder.WriteString("\n" + formatCueTime(cue.start, ".") + " --> " + formatCueTime(cue.end, "."))
+		if cue.settings != "" {
+			builder.WriteString(" " + cue.settings)
+		}
+		builder.WriteString("\n" + strings.Join(cue.text, "\n") + "\n")
+	}
+	return builder.String()
+}
+
+// SRT has no styling, so the VTT tags are stripped from the text
+func formatSrt(cues []transcriptCue) string {
+	var builder strings.Builder
+	n := 0
+	for _, cue := range cues {
+		text := strings.TrimSpace(vttTagPattern.ReplaceAllString(strings.Join(cue.text, "\n"), ""))
+		if text == "" {
+			continue
+		}
+		n++
+		builder.WriteString(strconv.Itoa(n) + "\n")
+		builder.WriteString(formatCueTime(cue.start, ",") + " --> " + formatCueTime(cue.end, ",") + "\n")
+		builder.WriteString(text + "\n\n")
+	}
+	return builder.String()
+}
+
+func formatCueTime(seconds float64, separator string) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", millis/3600000, millis/60000%60, millis/1000%60, separator, millis%1000)
+}
@@ -4,25 +4,33 @@ import (
 	"context"
 	"fmt"
 	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
 	"ikoyhn/podcast-sponsorblock/internal/models"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	log "github.com/labstack/gommon/log"
 	"github.com/lrstanley/go-ytdlp"
-	"google.golang.org/api/option"
 	"google.golang.org/api/youtube/v3"
 )
 
-const youtubeVideoUrl = "https://www.youtube.com/watch?v="
+const (
+	youtubeVideoUrl       = "https://www.youtube.com/watch?v="
+	defaultVideoMaxHeight = 720
+	durationBackfillLimit = 200
 
-var youtubeVideoMutexes = &sync.Map{}
+	// streams and premieres still pending this long after they were published are not checked again
+	liveRecheckDeadline = 30 * 24 * time.Hour
+
+	// the player part sizes the embed to the aspect ratio of the video within this height
+	shortsEmbedMaxHeight = 640
+)
 
 // Get all youtube playlist items and meta data for the RSS feed
-func getYoutubePlaylistData(youtubePlaylistId string, service *youtube.Service) {
+func getYoutubePlaylistData(youtubePlaylistId string, service *youtube.Service, quota *quotaRun) {
 
 	log.Info("[RSS FEED] Getting youtube data...")
 
@@ -30,6 +38,11 @@ func getYoutubePlaylistData(youtubePlaylistId string, service *youtube.Service)
 	missingVideos := []models.PodcastEpisode{}
 	pageToken := "first_call"
 	for continue_requesting_playlist_items {
+		// the first ingest of a long playlist can use a lot of quota, keep the newest episodes found so far
+		if pageToken != "first_call" && isQuotaBudgetReached() {
+			log.Warn("[QUOTA] Daily budget reached, skipping the older episodes of " + youtubePlaylistId)
+			break
+		}
 		call := service.PlaylistItems.List([]string{"snippet", "status"}).
 			PlaylistId(youtubePlaylistId).
 			MaxResults(50)
@@ -39,9 +52,11 @@ func getYoutubePlaylistData(youtubePlaylistId string, service *youtube.Service)
 			call.PageToken(pageToken)
 		}
 
-		response, ytAgainErr := call.Do()
+		response, ytAgainErr := callYoutube(quota, "playlistItems.list", call.Do)
 		if ytAgainErr != nil {
-			log.Fatalf("Error calling YouTube API: %v. Ensure your API key is valid", response)
+			// with every key out of quota the refresh is picked up again after the reset
+			log.Errorf("Error calling YouTube API: %v. Ensure your API key is valid", ytAgainErr)
+			return
 		}
 		if response.HTTPStatusCode != http.StatusOK {
 			log.Errorf("YouTube API returned status code %v", response.HTTPStatusCode)
@@ -75,7 +90,7 @@ func getYoutubePlaylistData(youtubePlaylistId string, service *youtube.Service)
 	}
 }
 
-func getChannelData(channelIdentifier string, service *youtube.Service, isPlaylist bool) models.Podcast {
+func getChannelData(channelIdentifier string, service *youtube.Service, isPlaylist bool, quota *quotaRun) models.Podcast {
 	var channelCall *youtube.ChannelsListCall
 	var channelId string
 	dbPodcast := database.GetPodcast(channelIdentifier)
@@ -84,12 +99,14 @@ func getChannelData(channelIdentifier string, service *youtube.Service, isPlayli
 		if isPlaylist {
 			playlistCall := service.Playlists.List([]string{"snippet", "status", "contentDetails"}).
 				Id(channelIdentifier)
-			playlistResponse, err := playlistCall.Do()
+			playlistResponse, err := callYoutube(quota, "playlists.list", playlistCall.Do)
 			if err != nil {
 				log.Errorf("Error retrieving playlist details: %v", err)
+				return models.Podcast{Id: channelIdentifier}
 			}
 			if len(playlistResponse.Items) == 0 {
 				log.Errorf("Playlist not found")
+				return models.Podcast{Id: channelIdentifier}
 			}
 			playlist := playlistResponse.Items[0]
 			channelId = playlist.Snippet.ChannelId
@@ -99,12 +116,14 @@ func getChannelData(channelIdentifier string, service *youtube.Service, isPlayli
 
 		channelCall = service.Channels.List([]string{"snippet", "statistics", "contentDetails"}).
 			Id(channelId)
-		channelResponse, err := channelCall.Do()
+		channelResponse, err := callYoutube(quota, "channels.list", channelCall.Do)
 		if err != nil {
 			log.Errorf("Error retrieving channel details: %v", err)
+			return models.Podcast{Id: channelIdentifier}
 		}
 		if len(channelResponse.Items) == 0 {
 			log.Errorf("Channel not found")
+			return models.Podcast{Id: channelIdentifier}
 		}
 		channel := channelResponse.Items[0]
 
@@ -119,8 +138,14 @@ func getChannelData(channelIdentifier string, service *youtube.Service, isPlayli
 			imageUrl = channel.Snippet.Thumbnails.Default.Url
 		}
 
+		podcastType := enum.CHANNEL
+		if isPlaylist {
+			podcastType = enum.PLAYLIST
+		}
+
 		dbPodcast = &models.Podcast{
 			Id:              channelIdentifier,
+			Type:            string(podcastType),
 			PodcastName:     channel.Snippet.Title,
 			Description:     channel.Snippet.Description,
 			ImageUrl:        imageUrl,
@@ -129,6 +154,9 @@ func getChannelData(channelIdentifier string, service *youtube.Service, isPlayli
 			ArtistName:      channel.Snippet.Title,
 			Explicit:        "false",
 		}
+		if !isPlaylist && channel.ContentDetails != nil && channel.ContentDetails.RelatedPlaylists != nil {
+			dbPodcast.UploadsPlaylistId = channel.ContentDetails.RelatedPlaylists.Uploads
+		}
 
 		dbPodcast.LastBuildDate = time.Now().Format(time.RFC1123)
 		database.SavePodcast(dbPodcast)
@@ -136,92 +164,97 @@ func getChannelData(channelIdentifier string, service *youtube.Service, isPlayli
 
 	return *dbPodcast
 }
-func getChannelMetadataAndVideos(channelID string, service *youtube.Service) {
+
+// Page through the uploads playlist of the channel, newest first, until the already saved episodes are reached.
+// Playlist items cost 1 quota unit per page where a search costs 100.
+func getChannelMetadataAndVideos(channelID string, service *youtube.Service, quota *quotaRun) {
 	log.Info("[RSS FEED] Getting channel data...")
-	doesChannelExist := findChannel(channelID, service)
-	if !doesChannelExist {
+	uploadsPlaylistId := getUploadsPlaylistId(channelID, service, quota)
+	if uploadsPlaylistId == "" {
 		return
 	}
 
-	missingVideos := []models.PodcastEpisode{}
 	nextPageToken := ""
 	for {
-		channelVideosCall := service.Search.List([]string{"snippet"})
-		channelVideosCall.ChannelId(channelID)
-		channelVideosCall.Order("date")
-		channelVideosCall.MaxResults(50)
-		channelVideosCall.PageToken(nextPageToken)
-		channelVideosCall.Type("video")
-
-		channelVideoResponse, err := channelVideosCall.Do()
+		// the first ingest of a channel can use a lot of quota, keep the newest episodes found so far
+		if nextPageToken != "" && isQuotaBudgetReached() {
+			log.Warn("[QUOTA] Daily budget reached, skipping the older episodes of " + channelID)
+			break
+		}
+		call := service.PlaylistItems.List([]string{"contentDetails"}).
+			PlaylistId(uploadsPlaylistId).
+			MaxResults(50).
+			PageToken(nextPageToken)
+		response, err := callYoutube(quota, "playlistItems.list", call.Do)
 		if err != nil {
 			log.Error(err)
 			return
 		}
 
-		videoIds := getUnSavedEpisodeIds(channelVideoResponse)
-		missingVideos = findMissingPodcastEpisodes(service, videoIds, missingVideos)
-
-		if len(missingVideos) > 0 {
-			database.SavePlaylistEpisodes(missingVideos)
-			missingVideos = []models.PodcastEpisode{}
-		} else {
-			break
+		videoIds := getUnSavedEpisodeIds(response)
+		if len(videoIds) > 0 {
+			if episodes := findMissingPodcastEpisodes(service, videoIds, quota); len(episodes) > 0 {
+				database.SavePlaylistEpisodes(episodes)
+			}
 		}
 
-		if channelVideoResponse.NextPageToken == "" {
+		// the rest of the uploads are older than a saved episode
+		if len(videoIds) < len(response.Items) || response.NextPageToken == "" {
 			break
 		}
-		nextPageToken = channelVideoResponse.NextPageToken
+		nextPageToken = response.NextPageToken
 	}
 }
 
-func findChannel(channelID string, service *youtube.Service) bool {
-	exists, err := database.PodcastExists(channelID)
+// Get the uploads playlist of the channel, it is saved with the podcast so it is only looked up once
+func getUploadsPlaylistId(channelID string, service *youtube.Service, quota *quotaRun) string {
+	podcast := database.GetPodcast(channelID)
+	if podcast != nil && podcast.UploadsPlaylistId != "" {
+		return podcast.UploadsPlaylistId
+	}
+
+	channelCall := service.Channels.List([]string{"contentDetails"}).Id(channelID)
+	channelResponse, err := callYoutube(quota, "channels.list", channelCall.Do)
 	if err != nil {
 		log.Error(err)
-		return true
+		return ""
+	}
+	if len(channelResponse.Items) == 0 || channelResponse.Items[0].ContentDetails == nil || channelResponse.Items[0].ContentDetails.RelatedPlaylists == nil {
+		log.Error("channel not found")
+		return ""
 	}
 
-	if !exists {
-		channelCall := service.Channels.List([]string{"snippet", "statistics", "contentDetails"})
-		channelCall = channelCall.Id(channelID)
-
-		channelResponse, err := channelCall.Do()
-		if err != nil {
-			log.Error(err)
-			return false
-		}
-
-		if len(channelResponse.Items) == 0 {
-			log.Error("channel not found")
-			return false
-		}
+	uploadsPlaylistId := channelResponse.Items[0].ContentDetails.RelatedPlaylists.Uploads
+	if podcast != nil {
+		database.UpdatePodcastUploadsPlaylistId(channelID, uploadsPlaylistId)
 	}
-	return true
+	return uploadsPlaylistId
 }
 
-func getUnSavedEpisodeIds(channelVideoResponse *youtube.SearchListResponse) []string {
+func getUnSavedEpisodeIds(response *youtube.PlaylistItemListResponse) []string {
 	videoIds := []string{}
-	for _, item := range channelVideoResponse.Items {
-		if item.Id.Kind == "youtube#video" {
-			exists, err := database.EpisodeExists(item.Id.VideoId, "CHANNEL")
-			if err != nil {
-				log.Error(err)
-			}
-			if !exists {
-				videoIds = append(videoIds, item.Id.VideoId)
-			}
+	for _, item := range response.Items {
+		if item.ContentDetails == nil || item.ContentDetails.VideoId == "" {
+			continue
+		}
+		exists, err := database.EpisodeExists(item.ContentDetails.VideoId, "CHANNEL")
+		if err != nil {
+			log.Error(err)
+		}
+		if !exists {
+			videoIds = append(videoIds, item.ContentDetails.VideoId)
 		}
 	}
 	return videoIds
 }
 
-func findMissingPodcastEpisodes(service *youtube.Service, videoIds []string, missingVideos []models.PodcastEpisode) []models.PodcastEpisode {
-	videoCall := service.Videos.List([]string{"id,snippet,contentDetails"})
+func findMissingPodcastEpisodes(service *youtube.Service, videoIds []string, quota *quotaRun) []models.PodcastEpisode {
+	missingVideos := []models.PodcastEpisode{}
+	videoCall := service.Videos.List([]string{"id,snippet,contentDetails,liveStreamingDetails,player"})
 	videoCall = videoCall.Id(videoIds...)
+	videoCall = videoCall.MaxHeight(shortsEmbedMaxHeight)
 	videoCall = videoCall.MaxResults(int64(len(videoIds)))
-	videoResponse, err := videoCall.Do()
+	videoResponse, err := callYoutube(quota, "videos.list", videoCall.Do)
 	if err != nil {
 		log.Error(err)
 		return missingVideos
@@ -240,7 +273,86 @@ func findMissingPodcastEpisodes(service *youtube.Service, videoIds []string, mis
 	return missingVideos
 }
 
+// Playlist items have no duration, live status or aspect ratio, look them up in batches through the videos endpoint.
+// Live streams and premieres that were not available yet are checked again until they finish.
+func refreshEpisodeVideoDetails(podcastId string, service *youtube.Service, quota *quotaRun) {
+	if isQuotaBudgetReached() {
+		log.Info("[QUOTA] Daily budget reached, checking video details of " + podcastId + " after the quota reset")
+		return
+	}
+	episodes, err := database.GetEpisodesToRecheck(podcastId, getLiveRecheckSince(), durationBackfillLimit)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for start := 0; start < len(episodes); start += 50 {
+		if start > 0 && isQuotaBudgetReached() {
+			log.Info("[QUOTA] Daily budget reached, checking the remaining video details of " + podcastId + " after the quota reset")
+			return
+		}
+		end := min(start+50, len(episodes))
+		videoIds := make([]string, 0, end-start)
+		pendingIds := map[string]bool{}
+		for _, episode := range episodes[start:end] {
+			videoIds = append(videoIds, episode.YoutubeVideoId)
+			if episode.LiveStatus == string(enum.IS_LIVE) || episode.LiveStatus == string(enum.IS_UPCOMING) {
+				pendingIds[episode.YoutubeVideoId] = true
+			}
+		}
+
+		videoCall := service.Videos.List([]string{"snippet", "contentDetails", "liveStreamingDetails", "player"}).
+			Id(videoIds...).
+			MaxHeight(shortsEmbedMaxHeight).
+			MaxResults(50)
+		videoResponse, err := callYoutube(quota, "videos.list", videoCall.Do)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		for _, item := range videoResponse.Items {
+			delete(pendingIds, item.Id)
+			if item.ContentDetails == nil {
+				continue
+			}
+			duration, err := ParseDuration(item.ContentDetails.Duration)
+			if err != nil {
+				continue
+			}
+			liveStatus := models.GetVideoLiveStatus(item)
+			if liveStatus != enum.IS_LIVE && liveStatus != enum.IS_UPCOMING && duration <= 0 {
+				continue
+			}
+			database.UpdateEpisodeVideoDetails(item.Id, duration, string(liveStatus), models.IsShortVideo(item, duration))
+		}
+		// removed and private videos are left out of the response, they are not looked up again
+		database.UpdateEpisodeDetailsCheckedDate(videoIds, time.Now().Unix())
+		if len(pendingIds) > 0 {
+			unavailableIds := make([]string, 0, len(pendingIds))
+			for videoId := range pendingIds {
+				unavailableIds = append(unavailableIds, videoId)
+			}
+			database.UpdateEpisodeLiveStatus(unavailableIds, string(enum.UNAVAILABLE))
+		}
+	}
+}
+
 func ParseDuration(durationStr string) (time.Duration, error) {
+	// Streams over a day long have a day part, ex. P1DT2H3M4S or P1D. Videos that are not available yet have
+	// a duration of P0D.
+	days := time.Duration(0)
+	if before, after, found := strings.Cut(strings.TrimPrefix(durationStr, "P"), "D"); found {
+		n, err := strconv.Atoi(before)
+		if err != nil {
+			return 0, err
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		if after == "" {
+			return days, nil
+		}
+		durationStr = "P" + after
+	}
+
 	// Remove the 'PT' prefix from the duration string
 	durationStr = strings.Replace(durationStr, "PT", "", 1)
 
@@ -250,7 +362,13 @@ func ParseDuration(durationStr string) (time.Duration, error) {
 	durationStr = strings.Replace(durationStr, "S", "s", 1)
 
 	// Parse the duration string
-	return time.ParseDuration(durationStr)
+	duration, err := time.ParseDuration(durationStr)
+	return days + duration, err
+}
+
+// Get the published date before which pending streams and premieres are given up on
+func getLiveRecheckSince() string {
+	return time.Now().Add(-liveRecheckDeadline).UTC().Format(time.RFC3339)
 }
 
 // Remove unavailable youtube videos used during the RSS feed generation
@@ -269,87 +387,88 @@ func cleanPlaylistItems(item *youtube.PlaylistItem) *youtube.PlaylistItem {
 	return nil
 }
 
-func GetYoutubeVideo(youtubeVideoId string) (string, <-chan struct{}) {
-	mutex, ok := youtubeVideoMutexes.Load(youtubeVideoId)
-	if !ok {
-		mutex = &sync.Mutex{}
-		youtubeVideoMutexes.Store(youtubeVideoId, mutex)
-	}
-
-	mutex.(*sync.Mutex).Lock()
+// Queue the video for download, the returned channel is closed once the download attempt is over
+func GetYoutubeVideo(youtubeVideoId string, format MediaFormat) (string, <-chan struct{}) {
+	fileName := format.FileName(youtubeVideoId)
 
-	// Check if the file is already being processed
-	filePath := "/config/audio/" + youtubeVideoId + ".m4a"
-	if _, err := os.Stat(filePath); err == nil {
-		mutex.(*sync.Mutex).Unlock()
-		return youtubeVideoId, make(chan struct{})
+	done := make(chan struct{})
+	if _, err := os.Stat(format.FilePath(youtubeVideoId)); err == nil {
+		close(done)
+		return fileName, done
 	}
 
-	// If not, proceed with the download
-	youtubeVideoId = strings.TrimSuffix(youtubeVideoId, ".m4a")
+	waitForDownload(fileName, done)
+	queueDownload(youtubeVideoId, format, DOWNLOAD_PRIORITY_REQUEST)
+	return fileName, done
+}
+
+// Download the video in the given format with the SponsorBlock segments removed, or marked as chapters
+func downloadVideo(youtubeVideoId string, format MediaFormat) error {
 	ytdlp.Install(context.TODO(), nil)
 
-	categories := os.Getenv("SPONSORBLOCK_CATEGORIES")
-	if categories == "" {
-		categories = "sponsor"
-	}
-	categories = strings.TrimSpace(categories)
+	settings := database.GetFeedSettingsByVideoId(youtubeVideoId)
+	categories := strings.Join(getSponsorBlockCategories(settings), ",")
 
 	dl := ytdlp.New().
 		NoProgress().
-		FormatSort("ext::m4a").
-		SponsorblockRemove(categories).
-		ExtractAudio().
 		NoPlaylist().
 		FFmpegLocation("/usr/bin/ffmpeg").
 		Continue().
-		Paths("/config/audio").
-		ProgressFunc(500*time.Millisecond, func(prog ytdlp.ProgressUpdate) {
-			fmt.Printf(
-				"%s @ %s [eta: %s] :: %s\n",
-				prog.Status,
-				prog.PercentString(),
-				prog.ETA(),
-				prog.Filename,
-			)
-		}).
+		Paths(mediaDir).
+		ProgressFunc(500*time.Millisecond, trackDownloadProgress(youtubeVideoId, format)).
 		Output(youtubeVideoId + ".%(ext)s")
 
-	cookiesFile := strings.TrimSpace(os.Getenv("COOKIES_FILE"))
-	if cookiesFile != "" {
-		dl.Cookies("/config/" + cookiesFile)
-	}
-
-	done := make(chan struct{})
-	go func() {
-		r, err := dl.Run(context.TODO(), youtubeVideoUrl+youtubeVideoId)
-		if err != nil {
-			log.Errorf("Error downloading YouTube video: %v", err)
+	if format.MediaType == enum.VIDEO {
+		height := strconv.Itoa(getEnvInt("VIDEO_MAX_HEIGHT", defaultVideoMaxHeight))
+		dl.Format("bv*[height<=" + height + "][ext=mp4]+ba[ext=m4a]/b[height<=" + height + "][ext=mp4]/bv*[height<=" + height + "]+ba/b[height<=" + height + "]").
+			MergeOutputFormat(format.Extension)
+	} else {
+		switch format {
+		case AUDIO_M4A:
+			dl.FormatSort("ext::m4a")
+		case AUDIO_OPUS:
+			dl.FormatSort("acodec:opus")
 		}
-		if r.ExitCode != 0 {
-			log.Errorf("YouTube video download failed with exit code %d", r.ExitCode)
+		dl.ExtractAudio()
+		bitrate := getAudioBitrate(settings)
+		if format != AUDIO_M4A || bitrate != "" {
+			dl.AudioFormat(format.Extension)
 		}
-		mutex.(*sync.Mutex).Unlock()
-
-		close(done)
-	}()
+		if bitrate != "" {
+			dl.AudioQuality(bitrate)
+		}
+	}
 
-	return youtubeVideoId, done
-}
+	if getSponsorBlockMode(settings) == enum.MARK {
+		dl.SponsorblockMark(categories).
+			EmbedChapters()
+	} else {
+		dl.SponsorblockRemove(categories)
+	}
 
-func setupYoutubeService() *youtube.Service {
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		log.Fatalf("GOOGLE_API_KEY is not set")
+	cookiesFile := getCookiesFile(settings)
+	if cookiesFile != "" {
+		dl.Cookies("/config/" + cookiesFile)
 	}
 
-	ctx := context.Background()
-	service, err := youtube.NewService(ctx, option.WithAPIKey(apiKey))
+	setDownloadPhase(youtubeVideoId, format, enum.DOWNLOADING)
+	stopWatching := make(chan struct{})
+	go watchSponsorBlockPhase(youtubeVideoId, format, stopWatching)
+	defer close(stopWatching)
+
+	r, err := dl.Run(context.TODO(), youtubeVideoUrl+youtubeVideoId)
+	if r != nil && r.ExitCode != 0 {
+		return fmt.Errorf("yt-dlp exited with code %d: %s", r.ExitCode, stderrTail(r.Stderr))
+	}
 	if err != nil {
-		log.Errorf("Error creating new YouTube client: %v", err)
+		return err
 	}
-	if service == nil {
-		log.Errorf("Failed to create YouTube service: %v", err)
+
+	// subtitles are optional, a video without them still downloaded fine
+	if _, err := getTranscriptFile(youtubeVideoId); err != nil {
+		log.Debugf("[TRANSCRIPT] No subtitles for %s: %v", youtubeVideoId, err)
 	}
-	return service
+	// feeds only link the chapters of videos whose chapters were looked up
+	getYoutubeChapters(youtubeVideoId)
+	return nil
 }
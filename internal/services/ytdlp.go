@@ -0,0 +1,245 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"ikoyhn/podcast-sponsorblock/internal/database"
+	"ikoyhn/podcast-sponsorblock/internal/enum"
+	"ikoyhn/podcast-sponsorblock/internal/models"
+	"time"
+
+	log "github.com/labstack/gommon/log"
+	"github.com/lrstanley/go-ytdlp"
+)
+
+const (
+	youtubePlaylistUrl = "https://www.youtube.com/playlist?list="
+	youtubeChannelUrl  = "https://www.youtube.com/channel/"
+
+	// every pending video is a yt-dlp run, so only check the newest few on each refresh
+	liveRecheckLimit = 10
+)
+
+// ytdlpProvider looks up metadata by scraping YouTube with yt-dlp, no API key required
+type ytdlpProvider struct{}
+
+func (p *ytdlpProvider) GetChannelData(channelIdentifier string, isPlaylist bool) models.Podcast {
+	dbPodcast := database.GetPodcast(channelIdentifier)
+	if dbPodcast != nil {
+		return *dbPodcast
+	}
+
+	settings := database.GetFeedSettings(channelIdentifier)
+	channelId := channelIdentifier
+	if isPlaylist {
+		playlist, err := dumpFlatPlaylist(youtubePlaylistUrl+channelIdentifier, 1, settings)
+		if err != nil {
+			log.Errorf("Error retrieving playlist details: %v", err)
+			return models.Podcast{Id: channelIdentifier}
+		}
+		if playlist.ChannelID == nil {
+			log.Errorf("Playlist not found")
+			return models.Podcast{Id: channelIdentifier}
+		}
+		channelId = *playlist.ChannelID
+	}
+
+	channel, err := dumpFlatPlaylist(youtubeChannelUrl+channelId+"/videos", 1, settings)
+	if err != nil {
+		log.Errorf("Error retrieving channel details: %v", err)
+		return models.Podcast{Id: channelIdentifier}
+	}
+
+	channelName := channelId
+	if channel.Channel != nil {
+		channelName = *channel.Channel
+	} else if channel.Uploader != nil {
+		channelName = *channel.Uploader
+	}
+	description := ""
+	if channel.Description != nil {
+		description = *channel.Description
+	}
+
+	podcastType := enum.CHANNEL
+	if isPlaylist {
+		podcastType = enum.PLAYLIST
+	}
+
+	dbPodcast = &models.Podcast{
+		Id:              channelIdentifier,
+		Type:            string(podcastType),
+		PodcastName:     channelName,
+		Description:     description,
+		ImageUrl:        ytdlpChannelImage(channel),
+		PostedDate:      time.Now().Format(time.RFC3339),
+		PodcastEpisodes: []models.PodcastEpisode{},
+		ArtistName:      channelName,
+		Explicit:        "false",
+	}
+
+	dbPodcast.LastBuildDate = time.Now().Format(time.RFC1123)
+	database.SavePodcast(dbPodcast)
+	return *dbPodcast
+}
+
+func (p *ytdlpProvider) GetPlaylistEpisodes(youtubePlaylistId string) {
+	log.Info("[RSS FEED] Getting youtube data with yt-dlp...")
+	playlist, err := dumpFlatPlaylist(youtubePlaylistUrl+youtubePlaylistId, 0, database.GetFeedSettings(youtubePlaylistId))
+	if err != nil {
+		log.Errorf("Error retrieving playlist items: %v", err)
+		return
+	}
+	saveYtdlpEntries(playlist.Entries, youtubePlaylistId, enum.PLAYLIST)
+	recheckYtdlpLiveEpisodes(youtubePlaylistId)
+}
+
+func (p *ytdlpProvider) GetChannelEpisodes(channelId string) {
+	log.Info("[RSS FEED] Getting channel data with yt-dlp...")
+	channel, err := dumpFlatPlaylist(youtubeChannelUrl+channelId+"/videos", 0, database.GetFeedSettings(channelId))
+	if err != nil {
+		log.Errorf("Error retrieving channel videos: %v", err)
+		return
+	}
+	saveYtdlpEntries(channel.Entries, channelId, enum.CHANNEL)
+	recheckYtdlpLiveEpisodes(channelId)
+}
+
+// Look up the live streams and premieres that were not available yet, yt-dlp fails on them until they start
+func recheckYtdlpLiveEpisodes(podcastId string) {
+	episodes, err := database.GetPendingLiveEpisodes(podcastId, getLiveRecheckSince(), liveRecheckLimit)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, episode := range episodes {
+		info, err := dumpVideo(episode.YoutubeVideoId)
+		if err != nil {
+			log.Debugf("[RSS FEED] %s is not available yet: %v", episode.YoutubeVideoId, err)
+			continue
+		}
+		updated := models.NewPodcastEpisodeFromYtdlp(info, podcastId, episode.Type, episode.PublishedDate)
+		if updated.LiveStatus == "" {
+			updated.LiveStatus = string(enum.NOT_LIVE)
+		}
+		isShort := info.Width != nil && info.Height != nil && *info.Height > *info.Width &&
+			updated.Duration > 0 && updated.Duration <= 3*time.Minute
+		database.UpdateEpisodeVideoDetails(episode.YoutubeVideoId, updated.Duration, updated.LiveStatus, isShort)
+	}
+}
+
+// Dump the metadata of a single video
+func dumpVideo(youtubeVideoId string) (*ytdlp.ExtractedInfo, error) {
+	dl := ytdlp.New().
+		SkipDownload().
+		NoPlaylist().
+		DumpSingleJSON()
+
+	cookiesFile := getCookiesFile(database.GetFeedSettingsByVideoId(youtubeVideoId))
+	if cookiesFile != "" {
+		dl.Cookies("/config/" + cookiesFile)
+	}
+
+	r, err := dl.Run(context.TODO(), youtubeVideoUrl+youtubeVideoId)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(r.Stdout)
+	return ytdlp.ParseExtractedInfo(&raw)
+}
+
+func saveYtdlpEntries(entries []*ytdlp.ExtractedInfo, podcastId string, podcastType enum.PodcastType) {
+	missingVideos := []models.PodcastEpisode{}
+	for _, entry := range entries {
+		if entry == nil || entry.ID == "" || !isYtdlpEntryAvailable(entry) {
+			continue
+		}
+		exists, err := database.EpisodeExists(entry.ID, string(podcastType))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if !exists {
+			missingVideos = append(missingVideos, models.NewPodcastEpisodeFromYtdlp(entry, podcastId, string(podcastType), ytdlpPublishedDate(entry)))
+		}
+	}
+	if len(missingVideos) > 0 {
+		database.SavePlaylistEpisodes(missingVideos)
+	}
+}
+
+// Dump a playlist or channel tab as a single JSON document without resolving each video.
+// A limit of 0 returns every entry. The cookies file of the feed settings wins over COOKIES_FILE.
+func dumpFlatPlaylist(url string, limit int, settings *models.FeedSettings) (*ytdlp.ExtractedInfo, error) {
+	dl := ytdlp.New().
+		FlatPlaylist().
+		DumpSingleJSON().
+		ExtractorArgs("youtubetab:approximate_date")
+	if limit > 0 {
+		dl.PlaylistEnd(limit)
+	}
+
+	cookiesFile := getCookiesFile(settings)
+	if cookiesFile != "" {
+		dl.Cookies("/config/" + cookiesFile)
+	}
+
+	r, err := dl.Run(context.TODO(), url)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(r.Stdout)
+	return ytdlp.ParseExtractedInfo(&raw)
+}
+
+// Skip private, members only and deleted videos in a flat playlist
+func isYtdlpEntryAvailable(entry *ytdlp.ExtractedInfo) bool {
+	if entry.Availability != nil {
+		switch *entry.Availability {
+		case ytdlp.ExtractedAvailabilityPrivate, ytdlp.ExtractedAvailabilityUnlisted,
+			ytdlp.ExtractedAvailabilityNeedsAuth, ytdlp.ExtractedAvailabilityPremiumOnly,
+			ytdlp.ExtractedAvailabilitySubscriberOnly:
+			return false
+		}
+	}
+	if entry.Title != nil && (*entry.Title == "[Private video]" || *entry.Title == "[Deleted video]") {
+		return false
+	}
+	return true
+}
+
+func ytdlpPublishedDate(entry *ytdlp.ExtractedInfo) string {
+	if entry.Timestamp != nil {
+		return time.Unix(int64(*entry.Timestamp), 0).UTC().Format(time.RFC3339)
+	}
+	if entry.ReleaseTimestamp != nil {
+		return time.Unix(int64(*entry.ReleaseTimestamp), 0).UTC().Format(time.RFC3339)
+	}
+	if entry.UploadDate != nil {
+		if uploadDate, err := time.Parse("20060102", *entry.UploadDate); err == nil {
+			return uploadDate.Format(time.RFC3339)
+		}
+	}
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// Prefer the uncropped channel avatar, otherwise the widest thumbnail available
+func ytdlpChannelImage(channel *ytdlp.ExtractedInfo) string {
+	imageUrl := ""
+	maxWidth := -1
+	for _, thumbnail := range channel.Thumbnails {
+		if thumbnail == nil {
+			continue
+		}
+		if thumbnail.ID != nil && *thumbnail.ID == "avatar_uncropped" {
+			return thumbnail.URL
+		}
+		if thumbnail.Width != nil && *thumbnail.Width > maxWidth {
+			maxWidth = *thumbnail.Width
+			imageUrl = thumbnail.URL
+		} else if imageUrl == "" {
+			imageUrl = thumbnail.URL
+		}
+	}
+	return imageUrl
+}